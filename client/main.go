@@ -2,20 +2,89 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/dedis/protobuf"
 	"github.com/poechsel/Peerster/lib"
 	"net"
 	"strings"
+	"time"
 )
 
+/* Send a packet to the gossiper and wait for its answer */
+func exchange(udpConn *net.UDPConn, packet *lib.GossipPacket) *lib.GossipPacket {
+	packetBytes, err := protobuf.Encode(packet)
+	lib.ExitIfError(err)
+	udpConn.Write(packetBytes)
+
+	buffer := make([]byte, lib.UDPBUFFERSIZE)
+	udpConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := udpConn.Read(buffer)
+	lib.ExitIfError(err)
+	answer := &lib.GossipPacket{}
+	lib.ExitIfError(protobuf.Decode(buffer[:n], answer))
+	return answer
+}
+
+/* Send a download control message and print the answer of the gossiper */
+func controlDownloads(udpConn *net.UDPConn, control *lib.DownloadControl) {
+	answer := exchange(udpConn, &lib.GossipPacket{DownloadControl: control}).DownloadControl
+	if answer == nil {
+		return
+	}
+	if !answer.Ok {
+		fmt.Println("No download", answer.Target, "to", answer.Action)
+	}
+	for _, d := range answer.Downloads {
+		fmt.Printf("%s %s %s %d/%d chunks %d bytes %d B/s sources %s\n",
+			d.Id, d.Name, d.Status, d.ChunksDone, d.ChunksTotal,
+			d.Bytes, d.Rate, strings.Join(d.Sources, ","))
+		for _, e := range d.Errors {
+			fmt.Println("    error:", e)
+		}
+	}
+}
+
+/* Send a storage control message and print the answer of the gossiper */
+func controlStorage(udpConn *net.UDPConn, control *lib.StorageControl) {
+	answer := exchange(udpConn, &lib.GossipPacket{StorageControl: control}).StorageControl
+	if answer == nil {
+		return
+	}
+	if answer.Action == lib.StorageGC {
+		fmt.Println("Removed", answer.Files, "files,", answer.Freed, "bytes freed")
+	} else if answer.Action == lib.StorageUnshare {
+		fmt.Println("Unshared", strings.Join(answer.Removed, ","))
+	}
+	fmt.Println("Using", answer.Used, "bytes, quota", answer.Quota, "bytes")
+}
+
+/* Ask the gossiper to download a file by its name and print the answer */
+func controlResolve(udpConn *net.UDPConn, control *lib.ResolveControl) {
+	answer := exchange(udpConn, &lib.GossipPacket{ResolveControl: control}).ResolveControl
+	if answer == nil {
+		return
+	}
+	if !answer.Ok {
+		fmt.Println("Unknown name", answer.Name)
+		return
+	}
+	fmt.Println("Downloading", answer.Name, "of metahash", lib.HashToUid(answer.MetaHash))
+}
+
 func main() {
 	var port = flag.String("UIPort", "8080", "Port for the UI client")
 	var dest = flag.String("dest", "", "destination for the private message")
-	var file = flag.String("file", "", "file to be indexed by the gossiper, or filename of the requested file")
+	var file = flag.String("file", "", "file or directory to be indexed by the gossiper, or filename of the requested file")
 	var msg = flag.String("msg", "", "message to be sent")
 	var request = flag.String("request", "", "request a chunk or metafile of this hash")
+	var resolve = flag.String("resolve", "", "download the file registered under this name on the blockchain")
 	var budget = flag.Int("budget", 0, "Budget for the file search")
 	var keywords = flag.String("keywords", "", "Keywords to filter file with")
+	var downloads = flag.Bool("downloads", false, "list the downloads of the gossiper")
+	var progress = flag.String("progress", "", "show the progress of the download with this metahash or file name")
+	var cancel = flag.String("cancel", "", "cancel the download with this metahash or file name")
+	var unshare = flag.String("unshare", "", "stop sharing this file or directory")
+	var gc = flag.Bool("gc", false, "remove the chunks which don't belong to any file")
 	flag.Parse()
 
 	address := "127.0.0.1:" + *port
@@ -24,7 +93,19 @@ func main() {
 	udpConn, err := net.DialUDP("udp", nil, udpAddr)
 	lib.ExitIfError(err)
 
-	if *file != "" {
+	if *downloads {
+		controlDownloads(udpConn, &lib.DownloadControl{Action: lib.DownloadList})
+	} else if *progress != "" {
+		controlDownloads(udpConn, &lib.DownloadControl{Action: lib.DownloadList, Target: *progress})
+	} else if *cancel != "" {
+		controlDownloads(udpConn, &lib.DownloadControl{Action: lib.DownloadCancel, Target: *cancel})
+	} else if *unshare != "" {
+		controlStorage(udpConn, &lib.StorageControl{Action: lib.StorageUnshare, Target: *unshare})
+	} else if *gc {
+		controlStorage(udpConn, &lib.StorageControl{Action: lib.StorageGC})
+	} else if *resolve != "" {
+		controlResolve(udpConn, &lib.ResolveControl{Name: *resolve, File: *file, Peer: *dest})
+	} else if *file != "" {
 		if *request == "" {
 			p := lib.NewDataRequest(*file, *dest, []byte{})
 			gossip_packet :=
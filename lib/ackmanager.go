@@ -7,7 +7,9 @@ import (
 /* As we can't know if a channel is closed without reading
 it, I'm using two channels. One is to send the ack, the
 other is used as an indicator of the fact that the first
-is closed */
+is closed.
+The ack channel can hold one ack, so that sending it never blocks,
+even if the receiver gave up waiting */
 type AckRequest struct {
 	AckChannel chan interface{}
 	isClosed   bool
@@ -16,7 +18,7 @@ type AckRequest struct {
 
 func NewAckRequest() *AckRequest {
 	x := AckRequest{
-		AckChannel: make(chan interface{}),
+		AckChannel: make(chan interface{}, 1),
 		isClosed:   false,
 		lock:       &sync.Mutex{}}
 	return &x
@@ -25,16 +27,22 @@ func NewAckRequest() *AckRequest {
 func (ack *AckRequest) Close() {
 	ack.lock.Lock()
 	defer ack.lock.Unlock()
-	close(ack.AckChannel)
-	ack.isClosed = true
+	if !ack.isClosed {
+		close(ack.AckChannel)
+		ack.isClosed = true
+	}
 }
 
 func (ackr *AckRequest) SendAck(ack interface{}) bool {
 	ackr.lock.Lock()
 	defer ackr.lock.Unlock()
 	if !ackr.isClosed {
-		ackr.AckChannel <- ack
-		return true
+		select {
+		case ackr.AckChannel <- ack:
+			return true
+		default:
+			return false
+		}
 	} else {
 		return false
 	}
@@ -0,0 +1,89 @@
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/* Append only log of json records, one record per line.
+If the node crashed while writing, the last line can be incomplete: in
+this case we drop it when replaying and truncate the file to the last
+valid record, so that next appends are not glued to garbage */
+type appendLog struct {
+	lock *sync.Mutex
+	path string
+	file *os.File
+}
+
+func newAppendLog(path string) (*appendLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &appendLog{lock: &sync.Mutex{}, path: path, file: file}, nil
+}
+
+/* Call [f] on every valid record of the log, in order */
+func (l *appendLog) replay(f func(line []byte) error) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(l.file)
+	validUntil := int64(0)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if !json.Valid(line) {
+			break
+		}
+		if err := f(line); err != nil {
+			return err
+		}
+		validUntil += int64(len(line))
+	}
+
+	if info, err := l.file.Stat(); err == nil && info.Size() != validUntil {
+		fmt.Println("RECOVERING log", l.path, "dropping", info.Size()-validUntil, "bytes")
+		if err := l.file.Truncate(validUntil); err != nil {
+			return err
+		}
+	}
+	_, err := l.file.Seek(validUntil, io.SeekStart)
+	return err
+}
+
+func (l *appendLog) append(record interface{}) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+func (l *appendLog) close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,139 @@
+package lib
+
+/* Read only views of the blockchain, served by the web server */
+
+type WebTransaction struct {
+	Name      string
+	Size      int64
+	MetaHash  string
+	Publisher string
+}
+
+type WebBlock struct {
+	Hash         string
+	PrevHash     string
+	Height       int
+	Timestamp    int64
+	Difficulty   uint32
+	MerkleRoot   string
+	Transactions []WebTransaction
+}
+
+type WebLeaf struct {
+	Hash   string
+	Height int
+	IsHead bool
+}
+
+type WebName struct {
+	Name     string
+	MetaHash string
+	Owner    string
+	/* number of metafiles published for this name */
+	Versions int
+}
+
+func toWebTransaction(t *TxPublish) WebTransaction {
+	return WebTransaction{
+		Name:      t.File.Name,
+		Size:      t.File.Size,
+		MetaHash:  HashToUid(t.File.MetafileHash),
+		Publisher: HashToUid(t.PublicKey),
+	}
+}
+
+func (bc *BlockChain) toWebBlock(hash [32]byte) WebBlock {
+	block := bc.blocks[hash].block
+	transactions := []WebTransaction{}
+	for i := range block.Transactions {
+		transactions = append(transactions, toWebTransaction(&block.Transactions[i]))
+	}
+	return WebBlock{
+		Hash:         HashToUid(hash[:]),
+		PrevHash:     HashToUid(block.PrevHash[:]),
+		Height:       bc.ComputeLengthChain(hash),
+		Timestamp:    block.Timestamp,
+		Difficulty:   block.Difficulty,
+		MerkleRoot:   HashToUid(block.MerkleRoot[:]),
+		Transactions: transactions,
+	}
+}
+
+/* Blocks of the longest chain, from the head to the first block */
+func (bc *BlockChain) WebLongestChain() []WebBlock {
+	out := []WebBlock{}
+	bc.Inspect(func(bc *BlockChain) {
+		hash := bc.headChain
+		for !IsZeroHash(hash[:]) {
+			node, ok := bc.blocks[hash]
+			if !ok {
+				break
+			}
+			out = append(out, bc.toWebBlock(hash))
+			hash = node.parent
+		}
+	})
+	return out
+}
+
+func (bc *BlockChain) WebGetBlock(hash [32]byte) (WebBlock, bool) {
+	var out WebBlock
+	found := false
+	bc.Inspect(func(bc *BlockChain) {
+		if node, ok := bc.blocks[hash]; ok && node.block != nil {
+			out = bc.toWebBlock(hash)
+			found = true
+		}
+	})
+	return out, found
+}
+
+/* Every leaf of the block tree: the head of the longest chain, and
+the end of every fork. Blocks whose ancestors are missing are not
+reachable, hence not listed */
+func (bc *BlockChain) WebLeaves() []WebLeaf {
+	out := []WebLeaf{}
+	bc.Inspect(func(bc *BlockChain) {
+		for _, leaf := range bc.getLeaves([32]byte{}) {
+			if IsZeroHash(leaf[:]) {
+				continue
+			}
+			out = append(out, WebLeaf{
+				Hash:   HashToUid(leaf[:]),
+				Height: bc.ComputeLengthChain(leaf),
+				IsHead: leaf == bc.headChain,
+			})
+		}
+	})
+	return out
+}
+
+/* Transactions waiting to be mined */
+func (bc *BlockChain) WebMempool() []WebTransaction {
+	out := []WebTransaction{}
+	bc.Inspect(func(bc *BlockChain) {
+		for _, t := range bc.mempool.Transactions() {
+			out = append(out, toWebTransaction(&t))
+		}
+	})
+	return out
+}
+
+/* Resolve [name] using the longest chain */
+func (bc *BlockChain) WebResolveName(name string) (WebName, bool) {
+	var out WebName
+	found := false
+	bc.Inspect(func(bc *BlockChain) {
+		if entry, ok := bc.nameToHash[name]; ok {
+			hash := entry.CurrentHash()
+			out = WebName{
+				Name:     name,
+				MetaHash: HashToUid(hash[:]),
+				Owner:    HashToUid(entry.owner),
+				Versions: len(entry.hashes),
+			}
+			found = true
+		}
+	})
+	return out, found
+}
@@ -0,0 +1,161 @@
+package lib
+
+import (
+	"fmt"
+	"math/big"
+)
+
+/* When we receive a block whose parent is unknown, we ask the
+peer who sent it for the parent. The reply may itself have an
+unknown parent, in which case we ask again, until the chain connects.
+To catch up faster, a request asks for [Count] blocks: the block [Hash]
+and its ancestors */
+
+/* Number of blocks asked for in one request */
+var BLOCKSYNCBATCH uint32 = 16
+
+type BlockRequest struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Hash        [32]byte
+	Count       uint32
+}
+
+/* [Blocks] are ordered from the requested block to its oldest ancestor */
+type BlockReply struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	Blocks      []Block
+}
+
+/* Sent directly to a neighbor when we discover it, so that the
+node with the weakest chain can download the blocks it misses.
+[Work] is the work needed to build the chain, a big endian integer */
+type ChainStatus struct {
+	Origin string
+	Head   [32]byte
+	Length uint32
+	Work   []byte
+}
+
+/* Signal sent by the blockchain when a block is missing. [From] is the
+name of the peer who gave us a child of this block */
+type MissingBlock struct {
+	Hash [32]byte
+	From string
+}
+
+func NewBlockRequest(origin string, destination string, hash [32]byte, count uint32) *BlockRequest {
+	return &BlockRequest{
+		Origin:      origin,
+		Destination: destination,
+		HopLimit:    10,
+		Hash:        hash,
+		Count:       count,
+	}
+}
+
+func (msg *BlockRequest) ToPacket() *GossipPacket {
+	return &GossipPacket{BlockRequest: msg}
+}
+
+func (msg *BlockRequest) GetOrigin() string {
+	return msg.Origin
+}
+
+func (msg *BlockRequest) GetDestination() string {
+	return msg.Destination
+}
+
+func (msg *BlockRequest) NextHop() (PointToPoint, bool) {
+	if msg.HopLimit <= 1 {
+		return msg, false
+	} else {
+		return &BlockRequest{
+			Origin:      msg.Origin,
+			Destination: msg.Destination,
+			HopLimit:    msg.HopLimit - 1,
+			Hash:        msg.Hash,
+			Count:       msg.Count,
+		}, true
+	}
+}
+
+func (msg *BlockRequest) OnFirstEmission(state *State) {
+	fmt.Println("REQUESTING block", HashToUid(msg.Hash[:]), "from", msg.Destination)
+}
+
+/* We send at most BLOCKSYNCBATCH blocks, whatever the requester asks,
+and only as many as fit in one UDP packet: the oldest ones are dropped
+and will be asked for in the next request */
+func (msg *BlockRequest) OnReception(state *State, sendReply func(*GossipPacket)) {
+	count := msg.Count
+	if count > BLOCKSYNCBATCH {
+		count = BLOCKSYNCBATCH
+	}
+	blocks := state.BlockChain.GetAncestors(msg.Hash, int(count))
+	for len(blocks) > 0 {
+		reply := NewBlockReply(msg.Destination, msg.Origin, blocks)
+		if PacketSize(reply.ToPacket()) <= MAXPACKETSIZE {
+			sendReply(reply.ToPacket())
+			return
+		}
+		blocks = blocks[:len(blocks)-1]
+	}
+}
+
+func NewBlockReply(origin string, destination string, blocks []Block) *BlockReply {
+	return &BlockReply{
+		Origin:      origin,
+		Destination: destination,
+		HopLimit:    10,
+		Blocks:      blocks,
+	}
+}
+
+func (msg *BlockReply) ToPacket() *GossipPacket {
+	return &GossipPacket{BlockReply: msg}
+}
+
+func (msg *BlockReply) GetOrigin() string {
+	return msg.Origin
+}
+
+func (msg *BlockReply) GetDestination() string {
+	return msg.Destination
+}
+
+func (msg *BlockReply) NextHop() (PointToPoint, bool) {
+	if msg.HopLimit <= 1 {
+		return msg, false
+	} else {
+		return &BlockReply{
+			Origin:      msg.Origin,
+			Destination: msg.Destination,
+			HopLimit:    msg.HopLimit - 1,
+			Blocks:      msg.Blocks,
+		}, true
+	}
+}
+
+func (msg *BlockReply) OnFirstEmission(state *State) {
+}
+
+func (msg *BlockReply) OnReception(state *State, sendReply func(*GossipPacket)) {
+	fmt.Println("RECEIVED", len(msg.Blocks), "blocks from", msg.Origin)
+	/* Add the oldest block first: this way every block is connected
+	when appended, and only the parent of the oldest one can be missing */
+	for i := len(msg.Blocks) - 1; i >= 0; i-- {
+		state.BlockChain.AddBlock <- ReceivedBlock{Block: msg.Blocks[i], From: msg.Origin}
+	}
+}
+
+func NewChainStatus(origin string, head [32]byte, length int, work *big.Int) *ChainStatus {
+	return &ChainStatus{Origin: origin, Head: head, Length: uint32(length), Work: work.Bytes()}
+}
+
+func (msg *ChainStatus) ToPacket() *GossipPacket {
+	return &GossipPacket{ChainStatus: msg}
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"encoding/json"
+)
+
+/* A BlockStore saves every block added to the blockchain, so that
+the whole block tree (including forks) can be rebuilt after a restart */
+type BlockStore interface {
+	/* Return every block saved until now, in insertion order */
+	Load() ([]Block, error)
+	Append(block *Block) error
+	Close() error
+}
+
+/* Store keeping nothing: used when we don't want persistence */
+type memoryBlockStore struct{}
+
+func NewMemoryBlockStore() BlockStore {
+	return &memoryBlockStore{}
+}
+
+func (s *memoryBlockStore) Load() ([]Block, error) {
+	return []Block{}, nil
+}
+
+func (s *memoryBlockStore) Append(block *Block) error {
+	return nil
+}
+
+func (s *memoryBlockStore) Close() error {
+	return nil
+}
+
+/* Store writing every block inside an append only log */
+type logBlockStore struct {
+	log *appendLog
+}
+
+func NewLogBlockStore(path string) (BlockStore, error) {
+	log, err := newAppendLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &logBlockStore{log: log}, nil
+}
+
+func (s *logBlockStore) Load() ([]Block, error) {
+	out := []Block{}
+	err := s.log.replay(func(line []byte) error {
+		var block Block
+		if err := json.Unmarshal(line, &block); err != nil {
+			return err
+		}
+		out = append(out, block)
+		return nil
+	})
+	return out, err
+}
+
+func (s *logBlockStore) Append(block *Block) error {
+	return s.log.append(block)
+}
+
+func (s *logBlockStore) Close() error {
+	return s.log.close()
+}
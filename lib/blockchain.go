@@ -1,12 +1,15 @@
 package lib
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"math/rand"
+	"math/big"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,11 +18,14 @@ import (
 even when we are getting blocks in the reverse order (ex child before father).
 Special care was taken to deal with missing blocks.
 In order to ease the implementation, several choices were taken:
-- no caching. Intuitively, some properties, like the length of a chain
-starting from a given could be cached inside the node. However, due to hypothetic
-missing nodes, making sure this information is up to date is hard.
 - infering who are the missing blocks (inside waitingToBeResolved). We keep track
 of missing parents, and of who the child of these parents are.
+- caching. Each node knows if all his ancestors are known (it is "connected"),
+and in this case the height of the node and the cumulative work of the chain
+ending at it. When a missing block arrives, its descendants become connected
+and their cache is filled at this moment.
+- no recursion. With continuous mining chains get long, every traversal is
+done with a loop.
 
 In our test, if the Peerster is designed to mine continously and we do not take care
 of missing blocks then the conscencius will not be reached
@@ -29,43 +35,94 @@ of missing blocks then the conscencius will not be reached
 Each node stores:
 - the corresponding block
 - his father
-- a list of children */
+- a list of children
+- whether every ancestor is known, and if so the height of the node
+and the work needed to build the chain ending at it */
 type BlockChainNode struct {
-	parent   [32]byte
-	children [][32]byte
-	block    *Block
+	parent    [32]byte
+	children  [][32]byte
+	block     *Block
+	connected bool
+	height    int
+	work      *big.Int
 }
 
 func NewBlockChainNode(block *Block) *BlockChainNode {
 	return &BlockChainNode{
-		parent:   block.PrevHash,
-		children: [][32]byte{},
-		block:    block,
+		parent:    block.PrevHash,
+		children:  [][32]byte{},
+		block:     block,
+		connected: false,
+		height:    0,
+		work:      big.NewInt(0),
 	}
 }
 
+/* Expected number of hashes needed to mine a block of this difficulty */
+func BlockWork(difficulty uint32) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+/* Fill the cache of [node], whose parent is connected */
+func (node *BlockChainNode) connectTo(parent *BlockChainNode) {
+	node.connected = true
+	node.height = parent.height + 1
+	node.work = new(big.Int).Add(parent.work, BlockWork(node.block.Difficulty))
+}
+
 type MineEndSignal struct {
 	block    Block
 	duration time.Duration
+	/* generation of the miner who found the block */
+	generation uint64
 }
 
+/* A block together with the name of the peer we got it from.
+[From] is empty for the blocks we mined */
+type ReceivedBlock struct {
+	Block Block
+	From  string
+}
+
+/* What the longest chain knows about a name */
 type BlockChainMapEntry struct {
-	hash [32]byte
-	nb   int
+	/* public key of the first node who published the name */
+	owner []byte
+	/* metafiles published for this name along the chain, the last
+	one is the current one */
+	hashes [][32]byte
+	/* block which applied each of them: a transaction sent again in
+	another block is rejected there, and must not be reversed with it */
+	blocks [][32]byte
 }
 
-func NewBlockChainMapEntry(hash [32]byte) *BlockChainMapEntry {
+func NewBlockChainMapEntry(owner []byte) *BlockChainMapEntry {
 	return &BlockChainMapEntry{
-		hash: hash,
-		nb:   0,
+		owner:  owner,
+		hashes: [][32]byte{},
+		blocks: [][32]byte{},
 	}
 }
 
+func (entry *BlockChainMapEntry) CurrentHash() [32]byte {
+	return entry.hashes[len(entry.hashes)-1]
+}
+
+/* Sequence number of the next transaction for this name */
+func (entry *BlockChainMapEntry) NextSequence() uint64 {
+	return uint64(len(entry.hashes))
+}
+
 type BlockChain struct {
 	nameToHash     map[string]*BlockChainMapEntry
 	blocks         map[[32]byte](*BlockChainNode)
-	nextFilesToAdd []TxPublish
+	mempool        *Mempool
 	isMining       bool
+	/* Parent of the block being mined */
+	miningOn [32]byte
+	/* Incremented (atomically) each time we cancel the miner. A miner
+	stops as soon as the generation it was started with is outdated */
+	mineGeneration uint64
 	headChain      [32]byte
 	// Sometime, we can get a Block A with parent B before
 	// receiving Block B. We store somewhere that we now that
@@ -75,51 +132,66 @@ type BlockChain struct {
 
 	blockMinedSignal chan MineEndSignal
 
+	/* every block appended is also saved in this store */
+	store BlockStore
+
+	/* if non zero, every block must have this difficulty */
+	pinnedDifficulty uint32
+
+	/* number of goroutines used to mine */
+	miners int
+
+	/* Missing blocks we already asked for, and when */
+	requestedBlocks map[[32]byte]time.Time
+
 	ReleaseBlock chan Block
-	AddBlock     chan Block
+	MissingBlock chan MissingBlock
+	AddBlock     chan ReceivedBlock
+	inspect      chan func(*BlockChain)
 	TryBlock     chan TryWrapper
 	AddTxPublish chan TxPublish
 	TryTxPublish chan TryWrapper
 }
 
-/* Fill a map[seen] with all entries seen when traversing the longest chain */
-func (blockchain *BlockChain) FindForkHelper(start [32]byte, seen map[[32]byte]bool) {
-	if _, ok := seen[start]; ok {
-	} else {
-		seen[start] = true
-		if _, ok := blockchain.blocks[start]; !ok || IsZeroHash(start[:]) {
+/* Return the closest common ancestor of [a] and [b], two connected
+nodes. The highest one is moved back until both meet */
+func (blockchain *BlockChain) FindFork(a [32]byte, b [32]byte) [32]byte {
+	for a != b {
+		nodeA := blockchain.blocks[a]
+		nodeB := blockchain.blocks[b]
+		if nodeA.height >= nodeB.height {
+			a = nodeA.parent
 		} else {
-			blockchain.FindForkHelper(blockchain.blocks[start].parent, seen)
+			b = nodeB.parent
 		}
 	}
+	return a
 }
 
-/* Reverse every transactions until we collide with a node already seen
-(in this case, we've joined the previous chain). Return the number of steps and
-the hash of the first same block */
-func (blockchain *BlockChain) ReverseTransactionsChain(start [32]byte, step int, seen map[[32]byte]bool) (int, [32]byte) {
-	if _, ok := seen[start]; ok {
-		return step, start
-	} else {
-		seen[start] = true
-		if _, ok := blockchain.blocks[start]; !ok || IsZeroHash(start[:]) {
-			return step, start
-		} else {
-			blockchain.ReverseTransaction(blockchain.blocks[start].block)
-			return blockchain.ReverseTransactionsChain(
-				blockchain.blocks[start].parent,
-				step+1,
-				seen)
-		}
+/* Reverse every transactions of the chain ending in [start] until we
+reach its ancestor [until]. Return the number of blocks rewinded */
+func (blockchain *BlockChain) ReverseTransactionsChain(start [32]byte, until [32]byte) int {
+	step := 0
+	for start != until && !IsZeroHash(start[:]) {
+		node := blockchain.blocks[start]
+		blockchain.ReverseTransaction(node.block)
+		start = node.parent
+		step += 1
 	}
+	return step
 }
 
-/* Apply transactions of the chain ending in [start] until we reach [until] */
+/* Apply transactions of the chain ending in [start], starting after its
+ancestor [until]. Blocks are applied from the oldest to the newest */
 func (blockchain *BlockChain) ApplyTransactionsChain(start [32]byte, until [32]byte) {
-	if _, ok := blockchain.blocks[start]; !ok || IsZeroHash(start[:]) || start == until {
-	} else {
-		blockchain.ApplyTransaction(blockchain.blocks[start].block)
-		blockchain.ApplyTransactionsChain(blockchain.blocks[start].parent, until)
+	path := [](*Block){}
+	for start != until && !IsZeroHash(start[:]) {
+		node := blockchain.blocks[start]
+		path = append(path, node.block)
+		start = node.parent
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		blockchain.ApplyTransaction(path[i])
 	}
 }
 
@@ -130,74 +202,124 @@ func (BlockChain *BlockChain) Dump(conv map[[32]byte]string) {
 	}
 }*/
 
-/** Compute the length of the chain ending at [start]
+/** Return the length of the chain ending at [start]
 Sometime we can be missing a node (for ex for the chain a--b--[c]--d--e if
 we suppose we haven't received [c] when asking for the length of the chain
 ending at e). In this case we return a negative length **/
 func (BlockChain *BlockChain) ComputeLengthChain(start [32]byte) int {
-	if IsZeroHash(start[:]) {
-		return 0
-	} else if _, ok := BlockChain.blocks[start]; !ok {
-		return -(int(^uint(0) >> 1)) - 1
-	} else {
-		return BlockChain.ComputeLengthChain(BlockChain.blocks[start].parent) + 1
+	if node, ok := BlockChain.blocks[start]; ok && node.connected {
+		return node.height
 	}
+	return -(int(^uint(0) >> 1)) - 1
 }
 
+/* A transaction is applied only if it is published by the owner of
+the name, or if the name is still free, and if it directly follows the
+last transaction applied for the name (see TxPublish.Sequence).
+Transactions of the block don't need to be mined anymore */
 func (blockchain *BlockChain) ApplyTransaction(block *Block) {
+	hash := block.Hash()
 	for _, t := range block.Transactions {
-		if _, ok := blockchain.nameToHash[t.File.Name]; !ok {
-			hash := [32]byte{}
-			copy(hash[:], t.File.MetafileHash)
-			blockchain.nameToHash[t.File.Name] = NewBlockChainMapEntry(hash)
+		blockchain.mempool.Remove(&t)
+		entry, ok := blockchain.nameToHash[t.File.Name]
+		if ok && !entry.IsOwnedBy(t.PublicKey) {
+			fmt.Println("REJECTED transaction", t.File.Name, "not published by its owner")
+			continue
+		}
+		if (!ok && t.Sequence != 0) || (ok && t.Sequence != entry.NextSequence()) {
+			fmt.Println("REJECTED transaction", t.File.Name, "out of sequence")
+			continue
+		}
+		if !ok {
+			entry = NewBlockChainMapEntry(t.PublicKey)
+			blockchain.nameToHash[t.File.Name] = entry
 		}
-		blockchain.nameToHash[t.File.Name].nb += 1
+		entry.hashes = append(entry.hashes, t.MetafileHash32())
+		entry.blocks = append(entry.blocks, hash)
 	}
 }
 
+/* Undo ApplyTransaction. Transactions are reversed in the opposite
+order, transactions which were rejected are skipped.
+Transactions of the block must be mined again */
 func (blockchain *BlockChain) ReverseTransaction(block *Block) {
-	for _, t := range block.Transactions {
-		if _, ok := blockchain.nameToHash[t.File.Name]; ok {
-			blockchain.nameToHash[t.File.Name].nb -= 1
-			if blockchain.nameToHash[t.File.Name].nb <= 0 {
+	hash := block.Hash()
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		t := block.Transactions[i]
+		blockchain.mempool.Add(t)
+		if entry, ok := blockchain.nameToHash[t.File.Name]; ok && entry.IsOwnedBy(t.PublicKey) {
+			last := len(entry.hashes) - 1
+			if t.Sequence != uint64(last) || entry.blocks[last] != hash ||
+				entry.CurrentHash() != t.MetafileHash32() {
+				continue
+			}
+			entry.hashes = entry.hashes[:last]
+			entry.blocks = entry.blocks[:last]
+			if len(entry.hashes) == 0 {
 				delete(blockchain.nameToHash, t.File.Name)
 			}
 		}
 	}
 }
 
+/* Return true if the transaction would change the mapping of the
+longest chain: either the name is free, or the owner publishes a new
+metafile for it. In both cases it must be the next one in sequence */
+func (blockchain *BlockChain) IsNewTransaction(t *TxPublish) bool {
+	if entry, ok := blockchain.nameToHash[t.File.Name]; ok {
+		return entry.IsOwnedBy(t.PublicKey) && t.Sequence == entry.NextSequence() &&
+			entry.CurrentHash() != t.MetafileHash32()
+	}
+	return t.Sequence == 0
+}
+
 /* Given a node [start], return the list of leaves reachable from
 this node */
 func (blockchain *BlockChain) getLeaves(start [32]byte) [][32]byte {
-	if block, ok := blockchain.blocks[start]; ok {
-		if len(block.children) == 0 {
-			return [][32]byte{start}
-		} else {
-			o := [][32]byte{}
-			for _, child := range block.children {
-				o = append(o, blockchain.getLeaves(child)...)
-			}
-			return o
+	o := [][32]byte{}
+	if _, ok := blockchain.blocks[start]; !ok {
+		return o
+	}
+	stack := [][32]byte{start}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := blockchain.blocks[current]
+		if len(node.children) == 0 {
+			o = append(o, current)
 		}
-	} else {
-		return [][32]byte{}
+		stack = append(stack, node.children...)
 	}
+	return o
 }
 
-/* Update the longest chain to be the one ending in [hash] if possible */
+/* Update the longest chain to be the one ending in [hash] if it required
+more work to be built. On equality we keep the first one we saw */
 func (blockchain *BlockChain) UpdateLongestChain(hash [32]byte) {
-	if blockchain.ComputeLengthChain(hash) > blockchain.ComputeLengthChain(blockchain.headChain) {
-		seen := make(map[[32]byte]bool)
-		blockchain.FindForkHelper(hash, seen)
-		rewind, stop := blockchain.ReverseTransactionsChain(blockchain.headChain, 0, seen)
+	node := blockchain.blocks[hash]
+	head := blockchain.blocks[blockchain.headChain]
+	if node.connected && node.work.Cmp(head.work) > 0 {
+		stop := blockchain.FindFork(hash, blockchain.headChain)
+		rewind := blockchain.ReverseTransactionsChain(blockchain.headChain, stop)
 		blockchain.ApplyTransactionsChain(hash, stop)
-		block := blockchain.blocks[hash].block
-		if block.PrevHash != blockchain.headChain {
+		if node.parent != blockchain.headChain {
 			fmt.Println("FORK-LONGER", "rewind", rewind, "blocks")
 		}
 		blockchain.headChain = hash
 	}
+}
 
+/* Forget the block [hash] and every block descending from it */
+func (blockchain *BlockChain) removeSubtree(hash [32]byte) {
+	stack := [][32]byte{hash}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node, ok := blockchain.blocks[current]; ok {
+			stack = append(stack, node.children...)
+			delete(blockchain.blocks, current)
+		}
+	}
 }
 
 func (blockchain *BlockChain) AppendBlock(block *Block) {
@@ -211,9 +333,15 @@ func (blockchain *BlockChain) AppendBlock(block *Block) {
 		isForkShorter = true
 	}
 
+	currentBcn := NewBlockChainNode(block)
+	blockchain.blocks[hash] = currentBcn
+
 	/* Update the list of children for the parent node */
 	if parentBcn, ok := blockchain.blocks[block.PrevHash]; ok {
 		parentBcn.children = append(parentBcn.children, hash)
+		if parentBcn.connected {
+			currentBcn.connectTo(parentBcn)
+		}
 	} else {
 		blockchain.waitingToBeResolved[block.PrevHash] = append(blockchain.waitingToBeResolved[block.PrevHash], hash)
 	}
@@ -222,36 +350,49 @@ func (blockchain *BlockChain) AppendBlock(block *Block) {
 		fmt.Println("FORK-SHORTER", HashToUid(block.PrevHash[:]))
 	}
 
-	currentBcn := NewBlockChainNode(block)
-	blockchain.blocks[hash] = currentBcn
-
-	blockchain.UpdateLongestChain(hash)
-
-	/* if we already no this node has a child, then we fix the flag
-	This is like "missing node found"
-	Why doing it as the end ? Because we want to make sure every transactions are applied
-	Suppose we missed node C and we just saw it.
-	Then, if we are under: A-B-[C]-D-E, by first updating the longest chain with C we will
-	make sure every transactions before C are done, and then we can do securely the transactions
-	between E and C
-	Otherwise, we are only gonna do the transactions between E and C, C excluded. And it could
-	be even worse if before C the longest chain was A-I-J-K, and hence the transaction on
-	B wasn't yet computed. At least, that's how I see it
-	*/
+	/* if we already know this node has children, then this is a
+	"missing node found" */
 	if entry, ok := blockchain.waitingToBeResolved[hash]; ok {
 		currentBcn.children = entry
 		delete(blockchain.waitingToBeResolved, hash)
+	}
 
-		/* As we just connected two part of the blockchain, we might need
-		to update the longest chain to be ending in one of the node we just reconnected.
-		The question is how to find good candidates to be the new longest chain. New leaves
-		created by this node are interesting nodes to consider. If we wanted even more
-		optimisation, instead of testing every new leaf, we could only test the furthest leaf */
-		leaves := blockchain.getLeaves(hash)
-		for _, leaf := range leaves {
-			blockchain.UpdateLongestChain(leaf)
+	if !currentBcn.connected {
+		return
+	}
+
+	/* The descendants of the node, which were waiting for it, are now
+	connected: fill their cache. As we just connected two part of the
+	blockchain, the new longest chain might end in one of them: the best
+	candidate is the one with the most work.
+	They couldn't be fully checked when they arrived: the ones breaking
+	the rules of the chain are discarded with their descendants */
+	best := hash
+	stack := [][32]byte{hash}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := blockchain.blocks[current]
+		valid := [][32]byte{}
+		for _, child := range node.children {
+			if !blockchain.FollowsChainRules(blockchain.blocks[child].block) {
+				fmt.Println("DISCARDING block", HashToUid(child[:]), "invalid difficulty or timestamp")
+				blockchain.removeSubtree(child)
+			} else {
+				valid = append(valid, child)
+			}
+		}
+		node.children = valid
+		for _, child := range node.children {
+			childBcn := blockchain.blocks[child]
+			childBcn.connectTo(node)
+			if childBcn.work.Cmp(blockchain.blocks[best].work) > 0 {
+				best = child
+			}
+			stack = append(stack, child)
 		}
 	}
+	blockchain.UpdateLongestChain(best)
 }
 
 type TryWrapper struct {
@@ -264,26 +405,26 @@ func NewTryWrapper(c interface{}) *TryWrapper {
 }
 
 func (bc *BlockChain) ChainToString(start [32]byte) string {
-	if IsZeroHash(start[:]) {
-		return ""
-	} else {
-		if _, ok := bc.blocks[start]; ok {
-			block := bc.blocks[start].block
-			blockstr := HashToUid(start[:]) + ":"
-			blockstr += HashToUid(block.PrevHash[:]) + ":"
-
-			trstr := []string{}
-			for _, ct := range block.Transactions {
-				trstr = append(trstr, ct.File.Name)
-			}
-
-			blockstr += strings.Join(trstr, ",")
+	blocks := []string{}
+	for !IsZeroHash(start[:]) {
+		node, ok := bc.blocks[start]
+		if !ok {
+			break
+		}
+		block := node.block
+		blockstr := HashToUid(start[:]) + ":"
+		blockstr += HashToUid(block.PrevHash[:]) + ":"
 
-			return blockstr + " " + bc.ChainToString(bc.blocks[start].parent)
-		} else {
-			return ""
+		trstr := []string{}
+		for _, ct := range block.Transactions {
+			trstr = append(trstr, ct.File.Name)
 		}
+
+		blockstr += strings.Join(trstr, ",")
+		blocks = append(blocks, blockstr+" ")
+		start = node.parent
 	}
+	return strings.Join(blocks, "")
 }
 
 func IsZeroHash(hash []byte) bool {
@@ -295,25 +436,162 @@ func IsZeroHash(hash []byte) bool {
 	return true
 }
 
-func (bc *BlockChain) mineInner(transaction []TxPublish, prevhash [32]byte) {
-	nextblock, time := Mine(transaction, prevhash)
-	bc.blockMinedSignal <- MineEndSignal{block: *nextblock, duration: time}
+/* If the block [hash] is unknown, ask [from] to send it to us.
+We don't ask twice for the same block in a short period of time, as
+several children of the same block can arrive together */
+func (bc *BlockChain) requestMissingBlock(hash [32]byte, from string) {
+	if _, ok := bc.blocks[hash]; ok || from == "" {
+		return
+	}
+	if last, ok := bc.requestedBlocks[hash]; ok && time.Since(last) < 5*time.Second {
+		return
+	}
+	bc.requestedBlocks[hash] = time.Now()
+	select {
+	case bc.MissingBlock <- MissingBlock{Hash: hash, From: from}:
+	default:
+	}
+}
+
+/* Run [f] inside the goroutine working on the blockchain, and wait
+for it to finish. This is the only safe way to read the blockchain from
+the outside */
+func (bc *BlockChain) Inspect(f func(*BlockChain)) {
+	done := make(chan bool)
+	bc.inspect <- func(bc *BlockChain) {
+		f(bc)
+		done <- true
+	}
+	<-done
+}
+
+func (bc *BlockChain) GetBlock(hash [32]byte) (Block, bool) {
+	var block Block
+	found := false
+	bc.Inspect(func(bc *BlockChain) {
+		if node, ok := bc.blocks[hash]; ok && node.block != nil {
+			block = *node.block
+			found = true
+		}
+	})
+	return block, found
+}
+
+/* Return the block [hash] followed by its ancestors, at most [count]
+blocks in total */
+func (bc *BlockChain) GetAncestors(hash [32]byte, count int) []Block {
+	out := []Block{}
+	bc.Inspect(func(bc *BlockChain) {
+		for len(out) < count {
+			node, ok := bc.blocks[hash]
+			if !ok || node.block == nil {
+				break
+			}
+			out = append(out, *node.block)
+			hash = node.parent
+		}
+	})
+	return out
+}
+
+/* Return the metahash registered for [name] on the longest chain */
+func (bc *BlockChain) ResolveName(name string) ([]byte, bool) {
+	var metahash []byte
+	bc.Inspect(func(bc *BlockChain) {
+		if entry, ok := bc.nameToHash[name]; ok {
+			hash := entry.CurrentHash()
+			metahash = hash[:]
+		}
+	})
+	return metahash, metahash != nil
+}
+
+/* Sequence number the next transaction of [publicKey] for [name] must
+have. Our own transactions still waiting in the mempool are counted, so
+that publishing twice in a row doesn't create two transactions with the
+same number */
+func (bc *BlockChain) NextSequence(name string, publicKey []byte) uint64 {
+	var next uint64
+	bc.Inspect(func(bc *BlockChain) {
+		if entry, ok := bc.nameToHash[name]; ok {
+			next = entry.NextSequence()
+		}
+		pending := bc.mempool.Transactions()
+		for found := true; found; {
+			found = false
+			for _, t := range pending {
+				if t.File.Name == name && t.Sequence == next && bytes.Equal(t.PublicKey, publicKey) {
+					next += 1
+					found = true
+				}
+			}
+		}
+	})
+	return next
+}
+
+/* Return the head of the longest chain, its length and the work
+needed to build it */
+func (bc *BlockChain) GetHead() ([32]byte, int, *big.Int) {
+	var head [32]byte
+	length := 0
+	work := big.NewInt(0)
+	bc.Inspect(func(bc *BlockChain) {
+		head = bc.headChain
+		length = bc.ComputeLengthChain(head)
+		if node, ok := bc.blocks[head]; ok {
+			work = new(big.Int).Set(node.work)
+		}
+	})
+	return head, length, work
+}
+
+func (bc *BlockChain) mineInner(transaction []TxPublish, prevhash [32]byte, minTimestamp int64, difficulty uint32, generation uint64) {
+	nextblock, time := Mine(transaction, prevhash, minTimestamp, difficulty, bc.miners, func() bool {
+		return atomic.LoadUint64(&bc.mineGeneration) != generation
+	})
+	if nextblock == nil {
+		fmt.Println("MINING-CANCELLED on", HashToUid(prevhash[:]))
+		return
+	}
+	bc.blockMinedSignal <- MineEndSignal{block: *nextblock, duration: time, generation: generation}
 }
+
 func (bc *BlockChain) MineNextBlock(mineContinuously bool) {
 	transaction := bc.GetNextTransactionsToMine()
 
 	if !bc.isMining && (mineContinuously || len(transaction) > 0) {
+		difficulty, ok := bc.ExpectedDifficulty(bc.headChain)
+		if !ok {
+			return
+		}
 		bc.isMining = true
-		go bc.mineInner(transaction, bc.headChain)
+		bc.miningOn = bc.headChain
+		go bc.mineInner(transaction, bc.headChain, bc.MinTimestamp(bc.headChain), difficulty, atomic.LoadUint64(&bc.mineGeneration))
 	}
 }
 
+/* If we are mining on top of a block which isn't the head anymore,
+the block we will find is already an orphan: stop the miner.
+Mining must then be restarted with MineNextBlock */
+func (bc *BlockChain) cancelOutdatedMining() {
+	if bc.isMining && bc.miningOn != bc.headChain {
+		atomic.AddUint64(&bc.mineGeneration, 1)
+		bc.isMining = false
+	}
+}
+
+/* Transactions of the mempool which still change our mapping.
+The others can't be mined anymore (for example the name was taken by
+someone else), we drop them */
 func (blockchain *BlockChain) GetNextTransactionsToMine() []TxPublish {
+	blockchain.mempool.Expire()
 	transaction := []TxPublish{}
-	for _, t := range blockchain.nextFilesToAdd {
-		if entry, ok := blockchain.nameToHash[t.File.Name]; !ok || (ok && entry.nb <= 0) {
+	for _, t := range blockchain.mempool.Transactions() {
+		if blockchain.IsNewTransaction(&t) {
 			transaction = append(transaction, t)
-
+		} else {
+			blockchain.mempool.Remove(&t)
 		}
 	}
 	return transaction
@@ -322,16 +600,19 @@ func (blockchain *BlockChain) GetNextTransactionsToMine() []TxPublish {
 func (bc *BlockChain) Work(mineCountinously bool) {
 	if mineCountinously {
 		// If we mine continously, init the mining process now
-		bc.isMining = true
-		go bc.mineInner([]TxPublish{}, [32]byte{})
+		bc.MineNextBlock(true)
 	}
 	for {
 		select {
 		case signal := <-bc.blockMinedSignal:
 			block := signal.block
+			if signal.generation != atomic.LoadUint64(&bc.mineGeneration) {
+				/* the miner was cancelled after finding this block */
+				break
+			}
 			bc.isMining = false
 
-			bc.AddBlock <- block
+			bc.AddBlock <- ReceivedBlock{Block: block}
 
 			/* Adding a random delay */
 			go func(signal MineEndSignal) {
@@ -343,39 +624,44 @@ func (bc *BlockChain) Work(mineCountinously bool) {
 				bc.ReleaseBlock <- signal.block
 			}(signal)
 
-		case block := <-bc.AddBlock:
+		case received := <-bc.AddBlock:
 			/* In part 2 we add every valid block to the blockchain:
 			the conscencius protocol will take care of updating the best chain */
-			if block.IsValid() {
+			block := received.Block
+			if _, ok := bc.blocks[block.Hash()]; !ok && block.IsValid() && bc.FollowsChainRules(&block) {
 				bc.AppendBlock(&block)
+				if err := bc.store.Append(&block); err != nil {
+					fmt.Println(err)
+				}
+				delete(bc.requestedBlocks, block.Hash())
+				bc.requestMissingBlock(block.PrevHash, received.From)
+
+				/* The transactions already included in the new head are
+				filtered out when restarting the miner */
+				bc.cancelOutdatedMining()
 
 				bc.MineNextBlock(mineCountinously)
 
 				fmt.Println("CHAIN", bc.ChainToString(bc.headChain))
 			}
 
+		case f := <-bc.inspect:
+			f(bc)
+
 		case tryBlock := <-bc.TryBlock:
 			block := tryBlock.content.(Block)
 			_, ok := bc.blocks[block.Hash()]
-			tryBlock.callback <- block.IsValid() && !ok
+			tryBlock.callback <- block.IsValid() && !ok && bc.FollowsChainRules(&block)
 
 		case tryTxPublish := <-bc.TryTxPublish:
 			/* we can add a TxPublish node iff:
-			- we haven't already seen it in our mapping
+			- it changes our mapping (see IsNewTransaction)
 			- we are not planning to add it in a block */
 			t := tryTxPublish.content.(TxPublish)
-			entry, ok := bc.nameToHash[t.File.Name]
-			seen := false
-			for _, f := range bc.nextFilesToAdd {
-				seen = seen || (f.File.Name == t.File.Name &&
-					f.File.Size == t.File.Size &&
-					HashToUid(f.File.MetafileHash) == HashToUid(t.File.MetafileHash))
-			}
-
-			tryTxPublish.callback <- (!ok || (ok && entry.nb <= 0)) && !seen
+			tryTxPublish.callback <- bc.IsNewTransaction(&t) && !bc.mempool.Contains(&t)
 
 		case txPublish := <-bc.AddTxPublish:
-			bc.nextFilesToAdd = append(bc.nextFilesToAdd, txPublish)
+			bc.mempool.Add(txPublish)
 
 			bc.MineNextBlock(mineCountinously)
 		}
@@ -387,22 +673,63 @@ func NewBlockChain() *BlockChain {
 		isMining:            false,
 		nameToHash:          make(map[string]*BlockChainMapEntry),
 		blocks:              make(map[[32]byte]*BlockChainNode),
-		nextFilesToAdd:      []TxPublish{},
+		mempool:             NewMempool(MEMPOOLTTL, MEMPOOLSIZE),
 		blockMinedSignal:    make(chan MineEndSignal, 10),
 		ReleaseBlock:        make(chan Block, 64),
-		AddBlock:            make(chan Block, 64),
+		MissingBlock:        make(chan MissingBlock, 64),
+		AddBlock:            make(chan ReceivedBlock, 64),
+		inspect:             make(chan func(*BlockChain)),
+		requestedBlocks:     make(map[[32]byte]time.Time),
 		TryBlock:            make(chan TryWrapper, 64),
 		AddTxPublish:        make(chan TxPublish, 64),
 		TryTxPublish:        make(chan TryWrapper, 64),
 		waitingToBeResolved: make(map[[32]byte][][32]byte),
+		store:               NewMemoryBlockStore(),
+		miners:              runtime.NumCPU(),
 	}
 
 	bc.headChain = [32]byte{}
-	bcn := &BlockChainNode{parent: bc.headChain, children: [][32]byte{}, block: nil}
+	bcn := &BlockChainNode{
+		parent:    bc.headChain,
+		children:  [][32]byte{},
+		block:     nil,
+		connected: true,
+		height:    0,
+		work:      big.NewInt(0),
+	}
 	bc.blocks[bc.headChain] = bcn
 	return bc
 }
 
+/* Use [store] to save the blocks. Every block already inside it is
+appended again, which replays the transactions and rebuilds the mapping
+name -> hash of the longest chain.
+Blocks are checked before being trusted: the file could have been
+modified while we were offline.
+Must be called before starting to work on the blockchain */
+func (bc *BlockChain) AttachStore(store BlockStore) error {
+	blocks, err := store.Load()
+	nLoaded := 0
+	for i := range blocks {
+		block := &blocks[i]
+		if _, ok := bc.blocks[block.Hash()]; ok {
+			continue
+		}
+		if !block.IsValid() || !bc.FollowsChainRules(block) {
+			hash := block.Hash()
+			fmt.Println("DISCARDING stored block", HashToUid(hash[:]))
+			continue
+		}
+		bc.AppendBlock(block)
+		nLoaded += 1
+	}
+	fmt.Println("RELOADED", nLoaded, "blocks")
+	fmt.Println("CHAIN", bc.ChainToString(bc.headChain))
+	bc.store.Close()
+	bc.store = store
+	return err
+}
+
 type BroadcastWithLimitCacher struct {
 	lock  *sync.Mutex
 	cache map[[32]byte]bool
@@ -437,20 +764,32 @@ type BroadcastWithLimit interface {
 }
 
 type TxPublish struct {
-	File     File
-	HopLimit uint32
-}
-
-func NewTxPublish(name string, metafilehash []byte, filesize int64) TxPublish {
+	File File
+	/* key of the publisher, and his signature of the transaction */
+	PublicKey []byte
+	Signature []byte
+	HopLimit  uint32
+	/* number of metafiles published for this name before this one.
+	It is signed, so an old transaction of the owner can't be sent again
+	to roll the name back */
+	Sequence uint64
+}
+
+func NewTxPublish(name string, metafilehash []byte, filesize int64, sequence uint64) TxPublish {
 	return TxPublish{
 		File: File{Name: name,
 			MetafileHash: metafilehash,
 			Size:         filesize},
 		HopLimit: 10,
+		Sequence: sequence,
 	}
 }
 
 func (msg *TxPublish) IsValidAndReceive(state *State) bool {
+	if !msg.VerifySignature() {
+		fmt.Println("REJECTED transaction", msg.File.Name, "invalid signature")
+		return false
+	}
 	var txpublish TxPublish
 	txpublish = *msg
 	try := NewTryWrapper(txpublish)
@@ -465,6 +804,12 @@ func (msg *TxPublish) IsValidAndReceive(state *State) bool {
 	return false
 }
 
+/* The metafile hash, as stored in the name mapping */
+func (t *TxPublish) MetafileHash32() (out [32]byte) {
+	copy(out[:], t.File.MetafileHash)
+	return
+}
+
 func (msg *TxPublish) ToPacket() *GossipPacket {
 	return &GossipPacket{TxPublish: msg}
 }
@@ -474,8 +819,11 @@ func (msg *TxPublish) NextHop() (BroadcastWithLimit, bool) {
 		return msg, false
 	} else {
 		return &TxPublish{
-			File:     msg.File,
-			HopLimit: msg.HopLimit - 1,
+			File:      msg.File,
+			PublicKey: msg.PublicKey,
+			Signature: msg.Signature,
+			HopLimit:  msg.HopLimit - 1,
+			Sequence:  msg.Sequence,
 		}, true
 	}
 }
@@ -489,12 +837,15 @@ func (msg *BlockPublish) ToKey() [32]byte {
 }
 
 type BlockPublish struct {
+	/* name of the peer who released the block. This is the peer
+	we will ask for the ancestors we are missing */
+	Origin   string
 	Block    Block
 	HopLimit uint32
 }
 
-func NewBlockPublish(block Block) *BlockPublish {
-	return &BlockPublish{Block: block, HopLimit: 20}
+func NewBlockPublish(origin string, block Block) *BlockPublish {
+	return &BlockPublish{Origin: origin, Block: block, HopLimit: 20}
 }
 
 func (msg *BlockPublish) NextHop() (BroadcastWithLimit, bool) {
@@ -502,6 +853,7 @@ func (msg *BlockPublish) NextHop() (BroadcastWithLimit, bool) {
 		return msg, false
 	} else {
 		return &BlockPublish{
+			Origin:   msg.Origin,
 			Block:    msg.Block,
 			HopLimit: msg.HopLimit - 1,
 		}, true
@@ -513,7 +865,7 @@ func (msg *BlockPublish) IsValidAndReceive(state *State) bool {
 	select {
 	case answer := <-try.callback:
 		if answer {
-			state.BlockChain.AddBlock <- msg.Block
+			state.BlockChain.AddBlock <- ReceivedBlock{Block: msg.Block, From: msg.Origin}
 		}
 		return answer
 	}
@@ -531,63 +883,73 @@ type File struct {
 }
 
 type Block struct {
-	PrevHash     [32]byte
-	Nonce        [32]byte
+	PrevHash [32]byte
+	Nonce    [32]byte
+	/* unix time at which the block was mined */
+	Timestamp int64
+	/* number of leading zero bits of the hash */
+	Difficulty uint32
+	/* root of the merkle tree of the transactions */
+	MerkleRoot   [32]byte
 	Transactions []TxPublish
 }
 
-func NewBlock(prev [32]byte, nonce [32]byte, transactions []TxPublish) *Block {
+func NewBlock(prev [32]byte, nonce [32]byte, timestamp int64, difficulty uint32, transactions []TxPublish) *Block {
 	return &Block{
 		PrevHash:     prev,
 		Nonce:        nonce,
+		Timestamp:    timestamp,
+		Difficulty:   difficulty,
+		MerkleRoot:   ComputeMerkleRoot(transactions),
 		Transactions: transactions,
 	}
 }
 
-func (b *Block) IsValid() bool {
-	hash := b.Hash()
-	isValid := true
-	/* Because there are 8bit in a byte */
-	for i := 0; i < 16/8; i++ {
-		isValid = isValid && (hash[i] == 0)
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{
+		PrevHash:   b.PrevHash,
+		Nonce:      b.Nonce,
+		Timestamp:  b.Timestamp,
+		Difficulty: b.Difficulty,
+		MerkleRoot: b.MerkleRoot,
 	}
-	return isValid
 }
 
-func Mine(transactions []TxPublish, PrevHash [32]byte) (*Block, time.Duration) {
-	start := time.Now()
-	for {
-		nonce := [32]byte{}
-		rand.Read(nonce[:])
-		block := NewBlock(PrevHash, nonce, transactions)
-		if block.IsValid() {
-			hash := block.Hash()
-			fmt.Println("FOUND-BLOCK", HashToUid(hash[:]))
-			return block, time.Since(start)
+/* Check the proof of work of the block, that the header matches the
+transactions and the signatures of the transactions. Whether the
+difficulty is the right one depends on the chain: see FollowsChainRules */
+func (b *Block) IsValid() bool {
+	if b.Difficulty < MINDIFFICULTY || !HasLeadingZeroBits(b.Hash(), b.Difficulty) {
+		return false
+	}
+	if b.MerkleRoot != ComputeMerkleRoot(b.Transactions) {
+		return false
+	}
+	for _, t := range b.Transactions {
+		if !t.VerifySignature() {
+			return false
 		}
 	}
-	return nil, time.Since(start)
+	return true
 }
 
-func (b *Block) Hash() (out [32]byte) {
-	h := sha256.New()
-	h.Write(b.PrevHash[:])
-	h.Write(b.Nonce[:])
-	binary.Write(h, binary.LittleEndian,
-		uint32(len(b.Transactions)))
-	for _, t := range b.Transactions {
-		th := t.Hash()
-		h.Write(th[:])
-	}
-	copy(out[:], h.Sum(nil))
-	return
+/* The hash of a block is the hash of its header */
+func (b *Block) Hash() [32]byte {
+	header := b.Header()
+	return header.Hash()
 }
+
+/* Covers what the transaction registers, like SigningHash: only the
+signature and the hop limit are left out */
 func (t *TxPublish) Hash() (out [32]byte) {
 	h := sha256.New()
 	binary.Write(h, binary.LittleEndian,
 		uint32(len(t.File.Name)))
 	h.Write([]byte(t.File.Name))
+	binary.Write(h, binary.LittleEndian, t.File.Size)
 	h.Write(t.File.MetafileHash)
+	h.Write(t.PublicKey)
+	binary.Write(h, binary.LittleEndian, t.Sequence)
 	copy(out[:], h.Sum(nil))
 	return
 }
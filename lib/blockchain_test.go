@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+/* The root of the tree has no block: mining and checking its first
+child must not need one */
+func TestMineFirstBlock(t *testing.T) {
+	bc := NewBlockChain()
+	bc.PinDifficulty(8)
+	bc.SetMiners(1)
+
+	bc.MineNextBlock(true)
+	var block Block
+	select {
+	case signal := <-bc.blockMinedSignal:
+		block = signal.block
+	case <-time.After(10 * time.Second):
+		t.Fatal("no block mined")
+	}
+	if !IsZeroHash(block.PrevHash[:]) {
+		t.Fatal("the first block has a parent")
+	}
+	if !block.IsValid() || !bc.FollowsChainRules(&block) {
+		t.Fatal("the first block mined is rejected")
+	}
+	bc.AppendBlock(&block)
+	if bc.headChain != block.Hash() {
+		t.Fatal("the first block isn't the head")
+	}
+
+	/* its child can't be older than it */
+	child, _ := Mine([]TxPublish{}, block.Hash(), bc.MinTimestamp(block.Hash()), 8, 1, func() bool { return false })
+	if child.Timestamp < block.Timestamp || !bc.FollowsChainRules(child) {
+		t.Fatal("the second block mined is rejected")
+	}
+	child.Timestamp = block.Timestamp - 1
+	if bc.HasValidTimestamp(child) {
+		t.Fatal("block older than its parent accepted")
+	}
+}
@@ -0,0 +1,264 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* The chunk store keeps chunks and metafiles in the temporary folder,
+named by their hash (metafiles end with .meta).
+
+Each hash has two counters:
+- refs: number of files of the FileManager using it
+- pins: number of reasons to never remove it: belonging to a file we
+share ourselves, or to a running download
+
+When the store gets bigger than its quota, the least recently used
+hashes which are not pinned are evicted, which tells the FileManager
+that we don't have them anymore.
+Collecting the garbage removes every hash which is neither referenced
+nor pinned */
+
+type storedChunk struct {
+	size    int64
+	meta    bool
+	lastUse time.Time
+}
+
+type ChunkStore struct {
+	lock    *sync.Mutex
+	folder  string
+	entries map[string]*storedChunk
+	refs    map[string]int
+	pins    map[string]int
+	used    int64
+	/* in bytes, 0 for no quota */
+	quota int64
+	/* called with the hashes evicted because of the quota */
+	onEvict func(uids []string)
+}
+
+var chunkStoreLock = &sync.Mutex{}
+var chunkStore *ChunkStore
+
+/* The store of the node, in TEMPFOLDER */
+func ChunkStorage() *ChunkStore {
+	chunkStoreLock.Lock()
+	defer chunkStoreLock.Unlock()
+
+	if chunkStore == nil || chunkStore.folder != TEMPFOLDER {
+		chunkStore = NewChunkStore(TEMPFOLDER)
+	}
+	return chunkStore
+}
+
+func isHashName(name string) bool {
+	return len(name) == 64 && UidIsValidHash(name)
+}
+
+/* Open the store of [folder], indexing the chunks already there */
+func NewChunkStore(folder string) *ChunkStore {
+	store := &ChunkStore{
+		lock:    &sync.Mutex{},
+		folder:  folder,
+		entries: make(map[string]*storedChunk),
+		refs:    make(map[string]int),
+		pins:    make(map[string]int),
+	}
+	files, _ := ioutil.ReadDir(folder)
+	for _, f := range files {
+		name := f.Name()
+		meta := strings.HasSuffix(name, ".meta")
+		uid := strings.TrimSuffix(name, ".meta")
+		if f.IsDir() || !isHashName(uid) {
+			continue
+		}
+		store.entries[uid] = &storedChunk{
+			size:    f.Size(),
+			meta:    meta,
+			lastUse: f.ModTime(),
+		}
+		store.used += f.Size()
+	}
+	return store
+}
+
+func (s *ChunkStore) path(uid string, meta bool) string {
+	if meta {
+		return s.folder + uid + ".meta"
+	}
+	return s.folder + uid
+}
+
+func (s *ChunkStore) SetQuota(quota int64) {
+	s.lock.Lock()
+	s.quota = quota
+	evicted := s.evict("")
+	onEvict := s.onEvict
+	s.lock.Unlock()
+
+	if onEvict != nil && len(evicted) > 0 {
+		onEvict(evicted)
+	}
+}
+
+func (s *ChunkStore) SetEvictCallback(f func(uids []string)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.onEvict = f
+}
+
+/* Store [data] under its hash and return this hash */
+func (s *ChunkStore) Put(data []byte, meta bool) string {
+	hash := sha256.Sum256(data)
+	uid := HashToUid(hash[:])
+
+	s.lock.Lock()
+	/* same hash, same content: no need to write it again */
+	if entry, ok := s.entries[uid]; ok {
+		entry.lastUse = time.Now()
+		s.lock.Unlock()
+		return uid
+	}
+	WriteFile(s.path(uid, meta), data)
+	s.entries[uid] = &storedChunk{
+		size:    int64(len(data)),
+		meta:    meta,
+		lastUse: time.Now(),
+	}
+	s.used += int64(len(data))
+	/* the caller didn't get a chance to pin it yet */
+	evicted := s.evict(uid)
+	onEvict := s.onEvict
+	s.lock.Unlock()
+
+	if onEvict != nil && len(evicted) > 0 {
+		onEvict(evicted)
+	}
+	return uid
+}
+
+/* Return the kind (MetaFileId, ChunkFileId or NoFileId) and the
+content of [hash] */
+func (s *ChunkStore) Get(hash []byte) (int, []byte) {
+	uid := HashToUid(hash)
+
+	s.lock.Lock()
+	entry, ok := s.entries[uid]
+	if ok {
+		entry.lastUse = time.Now()
+	}
+	s.lock.Unlock()
+
+	if !ok {
+		return NoFileId, []byte{}
+	}
+	data, err := ioutil.ReadFile(s.path(uid, entry.meta))
+	if err != nil {
+		return NoFileId, []byte{}
+	}
+	if entry.meta {
+		return MetaFileId, data
+	}
+	return ChunkFileId, data
+}
+
+func (s *ChunkStore) Ref(uid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.refs[uid] += 1
+}
+
+func (s *ChunkStore) Unref(uid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.refs[uid] -= 1
+	if s.refs[uid] <= 0 {
+		delete(s.refs, uid)
+	}
+}
+
+func (s *ChunkStore) Pin(uid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pins[uid] += 1
+}
+
+func (s *ChunkStore) Unpin(uid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pins[uid] -= 1
+	if s.pins[uid] <= 0 {
+		delete(s.pins, uid)
+	}
+}
+
+/* Must be called with the lock held */
+func (s *ChunkStore) remove(uid string) {
+	entry := s.entries[uid]
+	os.Remove(s.path(uid, entry.meta))
+	s.used -= entry.size
+	delete(s.entries, uid)
+}
+
+/* Evict the least recently used unpinned hashes, except [keep], until we
+are under the quota. Return the evicted hashes. Must be called with the
+lock held */
+func (s *ChunkStore) evict(keep string) []string {
+	evicted := []string{}
+	if s.quota <= 0 || s.used <= s.quota {
+		return evicted
+	}
+	candidates := []string{}
+	for uid := range s.entries {
+		if s.pins[uid] == 0 && uid != keep {
+			candidates = append(candidates, uid)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return s.entries[candidates[i]].lastUse.Before(s.entries[candidates[j]].lastUse)
+	})
+	for _, uid := range candidates {
+		if s.used <= s.quota {
+			break
+		}
+		s.remove(uid)
+		evicted = append(evicted, uid)
+	}
+	return evicted
+}
+
+/* Remove every hash neither referenced nor pinned. Return the number of
+files removed and the bytes freed */
+func (s *ChunkStore) CollectGarbage() (int, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	removed := 0
+	before := s.used
+	for uid := range s.entries {
+		if s.refs[uid] == 0 && s.pins[uid] == 0 {
+			s.remove(uid)
+			removed += 1
+		}
+	}
+	return removed, before - s.used
+}
+
+/* Bytes used and quota */
+func (s *ChunkStore) Usage() (int64, int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.used, s.quota
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+/* A Chunker cuts a stream in chunks. Next returns io.EOF once every
+chunk was returned.
+
+Two modes exist:
+- ChunkingFixed cuts every FILECHUNKSIZE bytes
+- ChunkingCDC (content defined chunking) cuts where a rolling hash of
+the last bytes read is below a threshold, with chunks between CDCMINSIZE
+and CDCMAXSIZE bytes, and about CDCAVGSIZE bytes on average. As the
+cuts depend only on the content, inserting a byte in a file only changes
+the chunk around it, and the other ones are deduplicated */
+type Chunker interface {
+	Next() ([]byte, error)
+}
+
+/* chunking mode used for the files we share */
+var CHUNKINGMODE uint8 = ChunkingFixed
+
+var CDCMINSIZE int = 2 * 1024
+var CDCAVGSIZE int = 8 * 1024
+var CDCMAXSIZE int = 16 * 1024
+
+func NewChunker(reader io.Reader, mode uint8) Chunker {
+	if mode == ChunkingCDC {
+		return newCdcChunker(reader)
+	}
+	return &fixedChunker{reader: reader, buffer: make([]byte, FILECHUNKSIZE)}
+}
+
+func ChunkingModeByName(name string) (uint8, bool) {
+	switch name {
+	case "fixed":
+		return ChunkingFixed, true
+	case "cdc":
+		return ChunkingCDC, true
+	}
+	return 0, false
+}
+
+type fixedChunker struct {
+	reader io.Reader
+	buffer []byte
+}
+
+func (c *fixedChunker) Next() ([]byte, error) {
+	n, err := io.ReadFull(c.reader, c.buffer)
+	if n == 0 {
+		return nil, err
+	}
+	chunk := make([]byte, n)
+	copy(chunk, c.buffer[:n])
+	return chunk, nil
+}
+
+/* The rolling hash is a gear hash: h = (h << 1) + gear[byte], so only
+the last 64 bytes matter. The table must be the same on every node,
+so it is derived from sha256 instead of being random */
+var gearTable = func() (table [256]uint64) {
+	for i := range table {
+		h := sha256.Sum256([]byte{byte(i)})
+		table[i] = binary.BigEndian.Uint64(h[:8])
+	}
+	return
+}()
+
+type cdcChunker struct {
+	reader *bufio.Reader
+	/* a cut happens when the hash is below it */
+	threshold uint64
+}
+
+/* Probability p of a cut at each byte past the minimum size. A chunk then
+gets on average (1 - (1-p)^n) / p bytes past the minimum size, n being
+CDCMAXSIZE - CDCMINSIZE: the cut at the maximum size makes it smaller
+than 1/p. p is found by bisection so that this is CDCAVGSIZE - CDCMINSIZE */
+func cdcCutProbability() float64 {
+	gap := float64(CDCAVGSIZE - CDCMINSIZE)
+	n := float64(CDCMAXSIZE - CDCMINSIZE)
+	if gap >= n {
+		return 0
+	}
+	if gap <= 1 {
+		return 1
+	}
+	/* the average decreases when p increases */
+	low, high := 0.0, 1.0
+	for i := 0; i < 64; i++ {
+		p := (low + high) / 2
+		if (1-math.Pow(1-p, n))/p > gap {
+			low = p
+		} else {
+			high = p
+		}
+	}
+	return (low + high) / 2
+}
+
+func newCdcChunker(reader io.Reader) *cdcChunker {
+	threshold := uint64(math.MaxUint64)
+	if p := cdcCutProbability(); p < 1 {
+		threshold = uint64(p * math.Exp2(64))
+	}
+	return &cdcChunker{
+		reader:    bufio.NewReader(reader),
+		threshold: threshold,
+	}
+}
+
+func (c *cdcChunker) Next() ([]byte, error) {
+	chunk := make([]byte, 0, CDCMAXSIZE)
+	var h uint64 = 0
+	for len(chunk) < CDCMAXSIZE {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			if len(chunk) > 0 && err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		chunk = append(chunk, b)
+		h = (h << 1) + gearTable[b]
+		if len(chunk) >= CDCMINSIZE && h < c.threshold {
+			break
+		}
+	}
+	return chunk, nil
+}
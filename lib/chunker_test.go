@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkerTestData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func readChunks(t *testing.T, data []byte, mode uint8) [][]byte {
+	chunker := NewChunker(bytes.NewReader(data), mode)
+	chunks := [][]byte{}
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func TestFixedChunker(t *testing.T) {
+	data := chunkerTestData(3*FILECHUNKSIZE+100, 1)
+	chunks := readChunks(t, data, ChunkingFixed)
+	if len(chunks) != 4 {
+		t.Fatalf("%d chunks instead of 4", len(chunks))
+	}
+	for i, chunk := range chunks[:3] {
+		if len(chunk) != FILECHUNKSIZE {
+			t.Fatalf("chunk %d has %d bytes", i, len(chunk))
+		}
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("the chunks don't give back the data")
+	}
+	if len(readChunks(t, []byte{}, ChunkingFixed)) != 0 {
+		t.Fatal("an empty file has chunks")
+	}
+}
+
+func TestCdcChunkSizes(t *testing.T) {
+	data := chunkerTestData(8<<20, 2)
+	chunks := readChunks(t, data, ChunkingCDC)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("the chunks don't give back the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > CDCMAXSIZE {
+			t.Fatalf("chunk %d has %d bytes", i, len(chunk))
+		}
+		if len(chunk) < CDCMINSIZE && i != len(chunks)-1 {
+			t.Fatalf("chunk %d has %d bytes", i, len(chunk))
+		}
+	}
+	average := len(data) / len(chunks)
+	if average < CDCAVGSIZE*9/10 || average > CDCAVGSIZE*11/10 {
+		t.Fatalf("chunks have %d bytes on average instead of %d", average, CDCAVGSIZE)
+	}
+}
+
+/* The hash of a run of zeros is constant, and not below the threshold:
+there is no cut, chunks have the maximum size but the last one */
+func TestCdcRepeatedContent(t *testing.T) {
+	data := make([]byte, 3*CDCMAXSIZE+100)
+	chunks := readChunks(t, data, ChunkingCDC)
+	if len(chunks) != 4 {
+		t.Fatalf("%d chunks in a file of zeros", len(chunks))
+	}
+	for _, chunk := range chunks[:3] {
+		if len(chunk) != CDCMAXSIZE {
+			t.Fatalf("chunk of %d bytes in a file of zeros", len(chunk))
+		}
+	}
+	if len(chunks[3]) != 100 {
+		t.Fatalf("last chunk of %d bytes", len(chunks[3]))
+	}
+}
+
+/* Inserting bytes only changes the chunks around them */
+func TestCdcInsertion(t *testing.T) {
+	data := chunkerTestData(1<<20, 3)
+	modified := append([]byte{}, data[:len(data)/2]...)
+	modified = append(modified, []byte("some inserted bytes")...)
+	modified = append(modified, data[len(data)/2:]...)
+
+	before := make(map[string]bool)
+	chunks := readChunks(t, data, ChunkingCDC)
+	for _, chunk := range chunks {
+		before[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range readChunks(t, modified, ChunkingCDC) {
+		if !before[string(chunk)] {
+			changed += 1
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("%d chunks out of %d changed", changed, len(chunks))
+	}
+}
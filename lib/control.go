@@ -0,0 +1,58 @@
+package lib
+
+/* Messages exchanged only between the client and its gossiper, through
+the fields of GossipPacket. The client sends a request and waits for the
+gossiper to answer with a message of the same type: the request fields
+are copied back, and the other ones filled with the result */
+
+/* List the downloads, follow one of them or cancel it.
+The answer holds the progress of the downloads concerned */
+type DownloadControl struct {
+	/* DownloadList or DownloadCancel */
+	Action string
+	/* id or name of a download, empty to list every download */
+	Target string
+	/* false if there is no such download, or it can't be cancelled */
+	Ok        bool
+	Downloads []DownloadProgress
+}
+
+const (
+	DownloadList   = "list"
+	DownloadCancel = "cancel"
+)
+
+/* Manage the chunk store: collect the garbage, unshare a file, or only
+get the usage. The answer always holds the usage after the action */
+type StorageControl struct {
+	/* StorageGC, StorageUnshare or StorageUsage */
+	Action string
+	/* name of the file to unshare */
+	Target string
+	/* names no longer shared */
+	Removed []string
+	/* files removed and bytes freed by the garbage collection */
+	Files uint64
+	Freed uint64
+	Used  uint64
+	Quota uint64
+}
+
+const (
+	StorageGC      = "gc"
+	StorageUnshare = "unshare"
+	StorageUsage   = "usage"
+)
+
+/* Download the file registered under a name on the blockchain. The
+answer tells whether the name is registered and gives its metahash; the
+download itself goes on in the background */
+type ResolveControl struct {
+	Name string
+	/* output file, the name if empty */
+	File string
+	/* peer to download from, empty to find one */
+	Peer     string
+	Ok       bool
+	MetaHash []byte
+}
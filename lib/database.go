@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"fmt"
 	"sync"
 )
 
@@ -29,10 +30,32 @@ func (entry *Entry) Insert(text string, id uint32) {
 type Database struct {
 	lock    *sync.Mutex
 	entries map[string](*Entry)
+	/* every new message is also written to this backend */
+	store RumorStore
 }
 
 func NewDatabase() Database {
-	return Database{lock: &sync.Mutex{}, entries: make(map[string](*Entry))}
+	return Database{
+		lock:    &sync.Mutex{},
+		entries: make(map[string](*Entry)),
+		store:   NewMemoryRumorStore(),
+	}
+}
+
+/* Use [store] as the storage backend of the database. Every rumor
+already saved inside it is reloaded */
+func (db *Database) AttachStore(store RumorStore) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	messages, err := store.Load()
+	for _, msg := range messages {
+		db.insertNoLock(&msg)
+	}
+	fmt.Println("RELOADED", len(messages), "rumors")
+	db.store.Close()
+	db.store = store
+	return err
 }
 
 func (db *Database) PossessRumorMessage(msg *RumorMessage) bool {
@@ -50,6 +73,18 @@ func (db *Database) InsertRumorMessage(msg *RumorMessage) {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
+	if entry, ok := db.entries[msg.Origin]; ok {
+		if _, ok := entry.messages[msg.ID]; ok {
+			return
+		}
+	}
+	db.insertNoLock(msg)
+	if err := db.store.Append(msg); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (db *Database) insertNoLock(msg *RumorMessage) {
 	if entry, ok := db.entries[msg.Origin]; ok {
 		entry.Insert(msg.Text, msg.ID)
 	} else {
@@ -81,6 +116,17 @@ func (db *Database) GetMinNotPresent(name string) uint32 {
 	return auxGetMinNotPresent(db.entries[name])
 }
 
+/* Return the greatest id stored for [name], 0 if we know nothing about it */
+func (db *Database) GetLastId(name string) uint32 {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if entry, ok := db.entries[name]; ok {
+		return auxGetMinNotPresent(entry) - 1
+	}
+	return 0
+}
+
 func (db *Database) GetPeerStatus() []PeerStatus {
 	db.lock.Lock()
 	defer db.lock.Unlock()
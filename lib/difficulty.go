@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"time"
+)
+
+/* The difficulty of a block is the number of leading zero bits its hash
+must have. It is stored inside the block and every [DIFFICULTYWINDOW]
+blocks it is recomputed from the timestamps of the last blocks:
+- if they were mined more than twice faster than [TARGETBLOCKTIME], the
+difficulty increases by one bit
+- if they were mined more than twice slower, it decreases by one bit
+A block whose difficulty doesn't follow this rule is rejected.
+
+As the retargeting trusts the timestamps, they are bounded: a block can't
+be older than its parent, nor more than [MAXFUTUREBLOCKTIME] in the
+future of our clock.
+A block whose parent is unknown can't be checked: it is checked once the
+missing blocks arrive, and discarded with its descendants if it is
+invalid (see AppendBlock) */
+
+var INITIALDIFFICULTY uint32 = 16
+var MINDIFFICULTY uint32 = 8
+var DIFFICULTYWINDOW int = 10
+var TARGETBLOCKTIME time.Duration = 10 * time.Second
+var MAXFUTUREBLOCKTIME time.Duration = 2 * time.Minute
+
+/* Return true if [hash] starts with at least [n] zero bits */
+func HasLeadingZeroBits(hash [32]byte, n uint32) bool {
+	if n > 256 {
+		return false
+	}
+	for i := uint32(0); i < n/8; i++ {
+		if hash[i] != 0 {
+			return false
+		}
+	}
+	if n%8 != 0 {
+		return hash[n/8]>>(8-n%8) == 0
+	}
+	return true
+}
+
+/* Pin the difficulty of every block to [difficulty]. Used for tests,
+where we want to mine fast and predictably. 0 keeps the adaptive difficulty */
+func (bc *BlockChain) PinDifficulty(difficulty uint32) {
+	bc.pinnedDifficulty = difficulty
+	if difficulty > 0 && difficulty < MINDIFFICULTY {
+		MINDIFFICULTY = difficulty
+	}
+}
+
+/* Return the difficulty a child of [parent] must have.
+The second value is false if we can't compute it because some
+ancestors of [parent] are missing */
+func (bc *BlockChain) ExpectedDifficulty(parent [32]byte) (uint32, bool) {
+	if bc.pinnedDifficulty > 0 {
+		return bc.pinnedDifficulty, true
+	}
+	if IsZeroHash(parent[:]) {
+		return INITIALDIFFICULTY, true
+	}
+	node, ok := bc.blocks[parent]
+	if !ok {
+		return 0, false
+	}
+	previous := node.block.Difficulty
+
+	height := bc.ComputeLengthChain(parent) + 1
+	if height <= 0 {
+		return 0, false
+	}
+	if height%DIFFICULTYWINDOW != 0 || height <= DIFFICULTYWINDOW {
+		return previous, true
+	}
+
+	/* find the first block of the window */
+	first := node
+	for i := 1; i < DIFFICULTYWINDOW; i++ {
+		first = bc.blocks[first.parent]
+	}
+	elapsed := time.Duration(node.block.Timestamp-first.block.Timestamp) * time.Second
+	expected := time.Duration(DIFFICULTYWINDOW-1) * TARGETBLOCKTIME
+
+	if elapsed < expected/2 {
+		return previous + 1, true
+	} else if elapsed > 2*expected && previous > MINDIFFICULTY {
+		return previous - 1, true
+	}
+	return previous, true
+}
+
+/* Check that the difficulty of [block] follows the retargeting rule.
+If the parent of the block is missing we can't know: we accept it */
+func (bc *BlockChain) HasExpectedDifficulty(block *Block) bool {
+	if expected, ok := bc.ExpectedDifficulty(block.PrevHash); ok {
+		return expected == block.Difficulty
+	}
+	return true
+}
+
+/* Smallest timestamp a child of [parent] can have. The root of the
+tree, of zero hash, has no block and doesn't bound its children */
+func (bc *BlockChain) MinTimestamp(parent [32]byte) int64 {
+	if IsZeroHash(parent[:]) {
+		return 0
+	}
+	if node, ok := bc.blocks[parent]; ok && node.block != nil {
+		return node.block.Timestamp
+	}
+	return 0
+}
+
+/* Check that [block] isn't older than its parent, when we know it, and
+isn't too far in the future */
+func (bc *BlockChain) HasValidTimestamp(block *Block) bool {
+	if block.Timestamp > time.Now().Add(MAXFUTUREBLOCKTIME).Unix() {
+		return false
+	}
+	return block.Timestamp >= bc.MinTimestamp(block.PrevHash)
+}
+
+/* Every check of [block] depending on the chain */
+func (bc *BlockChain) FollowsChainRules(block *Block) bool {
+	return bc.HasValidTimestamp(block) && bc.HasExpectedDifficulty(block)
+}
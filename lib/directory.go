@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/* A directory is shared as a single object: its manifest lists every
+file inside it, and is itself split in chunks and described by a
+metafile of kind MetaKindDirectory. Each file of the directory is also
+indexed on its own, under the name <directory>/<path> */
+
+type ManifestEntry struct {
+	/* relative to the directory, with '/' as separator */
+	Path     string
+	Size     int64
+	MetaHash string
+}
+
+type DirectoryManifest struct {
+	Name  string
+	Files []ManifestEntry
+}
+
+/* Name under which a directory appears in the file manager, and thus in
+search results */
+func DirectoryDisplayName(name string) string {
+	return strings.TrimSuffix(name, "/") + "/"
+}
+
+/* Check that a path coming from a manifest stays inside the directory */
+func CleanManifestPath(p string) (string, error) {
+	clean := path.Clean("/" + p)[1:]
+	if clean == "" || clean != p {
+		return "", errors.New("invalid path in manifest: " + p)
+	}
+	return clean, nil
+}
+
+/* Index every file of the shared directory [dir] and build its
+manifest. Return the root metafile of the manifest, the hashes of its
+chunks and its size */
+func (server *Gossiper) IndexDirectory(state *State, dir string) ([]byte, [][]byte, int64) {
+	manifest := DirectoryManifest{Name: dir, Files: []ManifestEntry{}}
+	root := SHAREDFOLDER + dir
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Println(err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		metahash, _, size := server.IndexFile(state, path.Join(dir, rel))
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			Path:     rel,
+			Size:     size,
+			MetaHash: metahash,
+		})
+		return nil
+	})
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		fmt.Println(err)
+		return []byte{}, [][]byte{}, 0
+	}
+	fmt.Println("INDEXED directory", dir, "with", len(manifest.Files), "files")
+	return SplitReader(bytes.NewReader(data), MetaKindDirectory)
+}
+
+/* Download every file of the directory whose manifest is made of
+[chunks], under [out_dir] */
+func (server *Gossiper) DownloadDirectory(state *State, download *Download, peer string, chunks [][]byte, out_dir string) bool {
+	data, err := ReadChunks(chunks)
+	if err != nil {
+		download.AddError(err.Error())
+		return false
+	}
+	var manifest DirectoryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		download.AddError("invalid manifest: " + err.Error())
+		return false
+	}
+
+	for _, entry := range manifest.Files {
+		p, err := CleanManifestPath(entry.Path)
+		if err != nil || !UidIsValidHash(entry.MetaHash) {
+			download.AddError("invalid entry " + entry.Path + " in manifest")
+			return false
+		}
+		if download.IsCancelled() {
+			return false
+		}
+		if !server.downloadDirectoryEntry(state, download, peer, UidToHash(entry.MetaHash), path.Join(out_dir, p)) {
+			download.AddError("can't download " + p)
+			return false
+		}
+	}
+	fmt.Println("DOWNLOADED directory", out_dir, "with", len(manifest.Files), "files")
+	return true
+}
+
+/* Download one file of a directory. It may already be downloading if
+it was resumed at startup: in that case we wait for it. Cancelling the
+directory cancels the file */
+func (server *Gossiper) downloadDirectoryEntry(state *State, download *Download, peer string, metahash []byte, out_file string) bool {
+	id := HashToUid(metahash)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-download.Cancelled():
+			state.Downloads.Cancel(id)
+		case <-stop:
+		}
+	}()
+
+	waitRunning := func() (bool, bool) {
+		if d, ok := state.Downloads.Get(id); ok && !d.IsFinished() {
+			<-d.Done()
+			return d.Status() == DownloadDone, true
+		}
+		return false, false
+	}
+
+	if success, running := waitRunning(); running {
+		return success
+	}
+	if server.DownloadFile(state, peer, metahash, out_file) {
+		return true
+	}
+	/* it may have been started in the meantime */
+	success, _ := waitRunning()
+	return success
+}
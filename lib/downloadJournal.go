@@ -0,0 +1,109 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/* Every running download is recorded in a journal, an append only log
+stored in the temporary folder as XXX.download, XXX being the metahash.
+The first record describes the download, the following ones are the
+chunks received. The journal is removed when the file is reconstructed,
+so at startup every remaining journal is a download to resume.
+A chunk recorded may have been removed from the store since then (by
+hand, or before the download was pinned at startup): DownloadFile checks
+it is still there */
+
+type JournalRecord struct {
+	Name     string `json:",omitempty"`
+	MetaHash string `json:",omitempty"`
+	Peer     string `json:",omitempty"`
+	Chunk    uint64 `json:",omitempty"`
+}
+
+type DownloadJournal struct {
+	log  *appendLog
+	path string
+}
+
+func journalPath(metahash string) string {
+	return TEMPFOLDER + metahash + ".download"
+}
+
+/* Open the journal of the download of [metahash], creating it if needed.
+Return the chunks already recorded */
+func OpenDownloadJournal(name string, metahash string, peer string) (*DownloadJournal, map[uint64]bool, error) {
+	path := journalPath(metahash)
+	log, err := newAppendLog(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	journal := &DownloadJournal{log: log, path: path}
+
+	done := make(map[uint64]bool)
+	nRecords := 0
+	err = log.replay(func(line []byte) error {
+		var record JournalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if record.Chunk > 0 {
+			done[record.Chunk] = true
+		}
+		nRecords += 1
+		return nil
+	})
+	if err == nil && nRecords == 0 {
+		err = log.append(JournalRecord{Name: name, MetaHash: metahash, Peer: peer})
+	}
+	return journal, done, err
+}
+
+func (j *DownloadJournal) RecordChunk(chunk uint64) {
+	if err := j.log.append(JournalRecord{Chunk: chunk}); err != nil {
+		fmt.Println(err)
+	}
+}
+
+/* The download stopped before the end: keep the journal to resume it */
+func (j *DownloadJournal) Close() {
+	j.log.close()
+}
+
+/* The download is over: forget it */
+func (j *DownloadJournal) Remove() {
+	j.log.close()
+	os.Remove(j.path)
+}
+
+/* Return the description of every download which didn't finish */
+func ListUnfinishedDownloads() []JournalRecord {
+	out := []JournalRecord{}
+	files, err := ioutil.ReadDir(TEMPFOLDER)
+	if err != nil {
+		return out
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".download") {
+			continue
+		}
+		log, err := newAppendLog(TEMPFOLDER + f.Name())
+		if err != nil {
+			continue
+		}
+		found := false
+		log.replay(func(line []byte) error {
+			var record JournalRecord
+			if !found && json.Unmarshal(line, &record) == nil && record.MetaHash != "" {
+				out = append(out, record)
+				found = true
+			}
+			return nil
+		})
+		log.close()
+	}
+	return out
+}
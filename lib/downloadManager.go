@@ -0,0 +1,314 @@
+package lib
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* The download manager keeps track of every download started since the
+node is running, so that they can be listed, followed and cancelled.
+A download is identified by the metahash of its file: we never download
+the same file twice at the same time */
+
+const (
+	DownloadMetafile    = "metafile"
+	DownloadDownloading = "downloading"
+	DownloadDone        = "done"
+	DownloadFailed      = "failed"
+	DownloadCancelled   = "cancelled"
+)
+
+/* number of errors kept for each download */
+var DOWNLOADERRORS int = 8
+
+type Download struct {
+	lock        *sync.Mutex
+	Id          string
+	Name        string
+	status      string
+	chunksDone  uint64
+	chunksTotal uint64
+	/* bytes received from the network by this download */
+	bytes uint64
+	/* peer -> number of chunks received from him */
+	sources  map[string]uint64
+	errors   []string
+	started  time.Time
+	finished time.Time
+	cancel   chan struct{}
+	done     chan struct{}
+}
+
+/* A snapshot of a download, sent to the client and to the web frontend */
+type DownloadProgress struct {
+	Id          string
+	Name        string
+	Status      string
+	ChunksDone  uint64
+	ChunksTotal uint64
+	Bytes       uint64
+	/* in bytes per second */
+	Rate    uint64
+	Sources []string
+	Errors  []string
+}
+
+type DownloadManager struct {
+	lock      *sync.Mutex
+	downloads map[string]*Download
+}
+
+func NewDownloadManager() *DownloadManager {
+	return &DownloadManager{
+		lock:      &sync.Mutex{},
+		downloads: make(map[string]*Download),
+	}
+}
+
+/* Register a new download. Fail if the same file is already being
+downloaded */
+func (m *DownloadManager) Start(name string, metahash string) (*Download, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if d, ok := m.downloads[metahash]; ok && !d.IsFinished() {
+		return nil, errors.New("already downloading " + metahash + " as " + d.Name)
+	}
+	d := NewDownload(name, metahash)
+	m.downloads[metahash] = d
+	return d, nil
+}
+
+/* A download which is not registered in a manager */
+func NewDownload(name string, metahash string) *Download {
+	return &Download{
+		lock:    &sync.Mutex{},
+		Id:      metahash,
+		Name:    name,
+		status:  DownloadMetafile,
+		sources: make(map[string]uint64),
+		errors:  []string{},
+		started: time.Now(),
+		cancel:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+/* Find a download either by its id or by the name of its file */
+func (m *DownloadManager) Get(idOrName string) (*Download, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if d, ok := m.downloads[idOrName]; ok {
+		return d, true
+	}
+	for _, d := range m.downloads {
+		if d.Name == idOrName {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+/* Return the progress of every download, the most recent first */
+func (m *DownloadManager) List() []DownloadProgress {
+	m.lock.Lock()
+	downloads := []*Download{}
+	for _, d := range m.downloads {
+		downloads = append(downloads, d)
+	}
+	m.lock.Unlock()
+
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].started.After(downloads[j].started)
+	})
+	out := []DownloadProgress{}
+	for _, d := range downloads {
+		out = append(out, d.Progress())
+	}
+	return out
+}
+
+/* Cancel a running download. Return false if there is no such download
+or if it is already finished */
+func (m *DownloadManager) Cancel(idOrName string) bool {
+	d, ok := m.Get(idOrName)
+	if !ok {
+		return false
+	}
+	return d.Cancel()
+}
+
+func (d *Download) Cancel() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.finished.IsZero() && d.status != DownloadCancelled {
+		d.status = DownloadCancelled
+		close(d.cancel)
+		return true
+	}
+	return false
+}
+
+/* Closed when the download is cancelled */
+func (d *Download) Cancelled() <-chan struct{} {
+	return d.cancel
+}
+
+func (d *Download) IsCancelled() bool {
+	select {
+	case <-d.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+/* Closed when the download is finished */
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *Download) Status() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.status
+}
+
+func (d *Download) IsFinished() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return !d.finished.IsZero()
+}
+
+/* We got the metafile: [done] of the [total] chunks are already there */
+func (d *Download) SetChunks(done uint64, total uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.chunksDone = done
+	d.chunksTotal = total
+	if d.status == DownloadMetafile {
+		d.status = DownloadDownloading
+	}
+}
+
+/* [size] bytes were received from [peer]. [chunk] is false for the
+metafile and for parity chunks */
+func (d *Download) Received(peer string, size int, chunk bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.bytes += uint64(size)
+	if chunk {
+		d.chunksDone += 1
+		d.sources[peer] += 1
+	}
+}
+
+/* A chunk was stored by someone else than the download, typically a
+stream of the same file */
+func (d *Download) Found() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.chunksDone += 1
+}
+
+/* A chunk was rebuilt from the parity chunks of its stripe */
+func (d *Download) Recovered() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.chunksDone += 1
+}
+
+func (d *Download) AddError(err string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.errors = append(d.errors, err)
+	if len(d.errors) > DOWNLOADERRORS {
+		d.errors = d.errors[len(d.errors)-DOWNLOADERRORS:]
+	}
+}
+
+/* Mark the download as finished with [status]. A cancelled download
+stays cancelled */
+func (d *Download) Finish(status string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.finished.IsZero() {
+		return
+	}
+	if d.status != DownloadCancelled {
+		d.status = status
+	}
+	d.finished = time.Now()
+	close(d.done)
+}
+
+func (d *Download) Progress() DownloadProgress {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	end := d.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	var rate uint64 = 0
+	if elapsed := end.Sub(d.started).Seconds(); elapsed > 0 {
+		rate = uint64(float64(d.bytes) / elapsed)
+	}
+	sources := []string{}
+	for peer := range d.sources {
+		sources = append(sources, peer)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return d.sources[sources[i]] > d.sources[sources[j]]
+	})
+	errs := make([]string, len(d.errors))
+	copy(errs, d.errors)
+	return DownloadProgress{
+		Id:          d.Id,
+		Name:        d.Name,
+		Status:      d.status,
+		ChunksDone:  d.chunksDone,
+		ChunksTotal: d.chunksTotal,
+		Bytes:       d.bytes,
+		Rate:        rate,
+		Sources:     sources,
+		Errors:      errs,
+	}
+}
+
+func (m *DownloadManager) HandleControl(control *DownloadControl) *DownloadControl {
+	answer := &DownloadControl{
+		Action:    control.Action,
+		Target:    control.Target,
+		Downloads: []DownloadProgress{},
+	}
+	if control.Action == DownloadList && control.Target == "" {
+		answer.Ok = true
+		answer.Downloads = m.List()
+		return answer
+	}
+
+	d, ok := m.Get(control.Target)
+	if !ok {
+		return answer
+	}
+	if control.Action == DownloadCancel {
+		answer.Ok = d.Cancel()
+	} else {
+		answer.Ok = true
+	}
+	answer.Downloads = append(answer.Downloads, d.Progress())
+	return answer
+}
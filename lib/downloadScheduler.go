@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* Downloads are done by a scheduler:
+- at most [DOWNLOADWINDOW] chunk requests of a file are in flight at the
+same time
+- a request not answered before its timeout is sent again, to another
+peer if possible, and the timeout is doubled (up to DOWNLOADMAXTIMEOUT)
+- after [DOWNLOADRETRIES] attempts the chunk, and hence the download, fails */
+
+var DOWNLOADWINDOW int = 8
+var DOWNLOADTIMEOUT time.Duration = 2 * time.Second
+var DOWNLOADMAXTIMEOUT time.Duration = 32 * time.Second
+var DOWNLOADRETRIES int = 8
+
+/* Send one request for [hash] to [peer] and wait at most [timeout] for
+the reply. Give up as soon as [cancelled] is closed */
+func (server *Gossiper) RequestOnce(state *State, peer string, hash []byte, timeout time.Duration, cancelled <-chan struct{}) (DataReply, bool) {
+	dataRequest := NewDataRequest(server.Name, peer, hash)
+	ackr := NewAckRequest()
+	state.AddDataAck(peer, HashToUid(hash), ackr)
+	defer ackr.Close()
+
+	go server.HandlePointToPointMessage(state, server.Address.String(), dataRequest)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return DataReply{}, false
+	case <-cancelled:
+		return DataReply{}, false
+	case r := <-ackr.AckChannel:
+		return r.(DataReply), true
+	}
+}
+
+/* Request [hash], part of the file downloaded by [download], until we
+get a reply whose content matches the hash.
+Peers are selected with [selectPeer], which must avoid the peers given
+as argument: they didn't answer in time. When every peer was avoided we
+try them again. A peer sending corrupted data is blacklisted for this
+file. Return the data and the peer who sent it */
+func (server *Gossiper) FetchHash(state *State, download *Download, hash []byte, selectPeer func(avoid map[string]bool) string) ([]byte, string, bool) {
+	return server.FetchHashAttempts(state, download, hash, DOWNLOADRETRIES, selectPeer)
+}
+
+/* Same as FetchHash, giving up after [attempts] attempts */
+func (server *Gossiper) FetchHashAttempts(state *State, download *Download, hash []byte, attempts int, selectPeer func(avoid map[string]bool) string) ([]byte, string, bool) {
+	metahash := download.Id
+	timeout := DOWNLOADTIMEOUT
+	avoid := make(map[string]bool)
+	for attempt := 0; attempt < attempts; attempt++ {
+		if download.IsCancelled() {
+			return nil, "", false
+		}
+		peer := selectPeer(avoid)
+		if peer == "" && len(avoid) > 0 {
+			avoid = make(map[string]bool)
+			peer = selectPeer(avoid)
+		}
+		if peer == "" {
+			download.AddError("no peer has " + HashToUid(hash))
+			return nil, "", false
+		}
+
+		sent := time.Now()
+		reply, ok := server.RequestOnce(state, peer, hash, timeout, download.Cancelled())
+		state.FileKnowledgeDB.OnRequestDone(metahash, peer)
+		if download.IsCancelled() {
+			return nil, "", false
+		}
+		if !ok {
+			fmt.Println("TIMEOUT", HashToUid(hash), "from", peer, "after", timeout)
+			download.AddError("timeout for " + HashToUid(hash) + " from " + peer)
+			avoid[peer] = true
+			timeout *= 2
+			if timeout > DOWNLOADMAXTIMEOUT {
+				timeout = DOWNLOADMAXTIMEOUT
+			}
+		} else if reply.IsValid() {
+			state.FileKnowledgeDB.OnReply(metahash, peer, time.Since(sent))
+			return reply.Data, peer, true
+		} else {
+			fmt.Println("BLACKLISTING", peer, "for", metahash)
+			download.AddError("corrupted " + HashToUid(hash) + " from " + peer)
+			state.FileKnowledgeDB.Blacklist(metahash, peer)
+		}
+	}
+	download.AddError("giving up " + HashToUid(hash))
+	return nil, "", false
+}
+
+/* Get the metafile [hash] of the file downloaded by [download], from
+the disk if we already have it, otherwise from [peer] or a peer having
+this file */
+func (server *Gossiper) FetchMetaFile(state *State, download *Download, peer string, hash []byte) ([]byte, bool) {
+	if metafile, ok := readVerifiedHash(hash); ok {
+		return metafile, true
+	}
+	metafile, from, ok := server.FetchHash(state, download, hash,
+		func(avoid map[string]bool) string {
+			return state.FileKnowledgeDB.SelectPeerForMetaHash(peer, download.Id, avoid)
+		})
+	if !ok {
+		return nil, false
+	}
+	fmt.Println("DOWNLOADING metafile", HashToUid(hash), "of", download.Name, "from", from)
+	WriteMetaFile(metafile)
+	download.Received(from, len(metafile), false)
+	return metafile, true
+}
+
+/* Get several sub metafiles at once. Return their contents in the order
+of [hashes] */
+func (server *Gossiper) FetchMetaFiles(state *State, download *Download, peer string, hashes [][]byte) ([][]byte, bool) {
+	out := make([][]byte, len(hashes))
+	tasks := []ChunkTask{}
+	for i, hash := range hashes {
+		tasks = append(tasks, ChunkTask{Id: uint64(i + 1), Hash: hash})
+	}
+	ok := ScheduleChunks(tasks, func(task ChunkTask) bool {
+		metafile, ok := server.FetchMetaFile(state, download, peer, task.Hash)
+		out[task.Id-1] = metafile
+		return ok
+	})
+	return out, ok
+}
+
+type ChunkTask struct {
+	/* chunks are counted starting 1 */
+	Id   uint64
+	Hash []byte
+}
+
+/* Run [fetch] on every task, with at most DOWNLOADWINDOW tasks running
+at the same time. As soon as a task fails, no new task is started.
+Return true if every task succeeded */
+func ScheduleChunks(tasks []ChunkTask, fetch func(ChunkTask) bool) bool {
+	window := make(chan bool, DOWNLOADWINDOW)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	failed := false
+
+	for _, task := range tasks {
+		window <- true
+		lock.Lock()
+		stop := failed
+		lock.Unlock()
+		if stop {
+			<-window
+			break
+		}
+
+		wg.Add(1)
+		go func(task ChunkTask) {
+			defer wg.Done()
+			if !fetch(task) {
+				lock.Lock()
+				failed = true
+				lock.Unlock()
+			}
+			<-window
+		}(task)
+	}
+	wg.Wait()
+	return !failed
+}
@@ -0,0 +1,423 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* Erasure coding.
+
+When enabled, the chunks of a file are grouped in stripes of
+ERASUREDATA chunks (the last stripe may be shorter), and ERASUREPARITY
+parity chunks are computed for each stripe with a Reed-Solomon code. The
+leaves of the metafile are then, for each stripe, the hashes of its data
+chunks followed by the hashes of its parity chunks, and the parameters
+are recorded in the header. Any ERASUREDATA chunks of a stripe, data or
+parity, are enough to get back the others: a file stays recoverable even
+if every peer having some chunks disappears.
+
+Chunks of a stripe don't have the same size. Each one is turned into a
+shard: its length on 4 bytes followed by its content, padded with zeros
+to the size of the biggest shard of the stripe. Parity chunks are shards
+too, so recovering a data chunk also gives back its length.
+
+The code is systematic: data chunks are stored as is, and the parity
+shard i is the sum over j of C[i][j] * data shard j, with the Cauchy
+matrix C[i][j] = 1 / (x_i + y_j), x_i = k + i and y_j = j, k being the
+number of data chunks of a full stripe. Every square matrix made of rows
+of the identity and of C is invertible, which is what makes any k shards
+enough */
+
+/* 0 to disable erasure coding */
+var ERASUREDATA int = 0
+var ERASUREPARITY int = 0
+
+/* Attempts for a data chunk before falling back on the parity chunks of
+its stripe (see FetchErasureCoded). Low, as the parity chunks are usually
+faster to get than waiting for all the retries */
+var ERASUREDATAATTEMPTS int = 1
+
+/* the x_i and y_j of the Cauchy matrix must be distinct elements of the
+field */
+const ERASUREMAXSHARDS int = 256
+
+/* Positions of the chunks of a stripe among the leaves of a metafile,
+counted starting 0 */
+type ErasureStripe struct {
+	Data   []int
+	Parity []int
+}
+
+/* Parse the parameters of the -erasure flag: "k,m", or "" or "off" to
+disable erasure coding */
+func ErasureParamsByName(name string) (int, int, bool) {
+	if name == "" || name == "off" {
+		return 0, 0, true
+	}
+	parts := strings.Split(name, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	k, err1 := strconv.Atoi(parts[0])
+	m, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || k < 1 || m < 1 || k+m > ERASUREMAXSHARDS {
+		return 0, 0, false
+	}
+	return k, m, true
+}
+
+func erasureCoefficient(k int, i int, j int) byte {
+	return gfInv(byte(k+i) ^ byte(j))
+}
+
+func toShard(chunk []byte, size int) ([]byte, error) {
+	if len(chunk)+4 > size {
+		return nil, errors.New("chunk bigger than the parity chunks")
+	}
+	shard := make([]byte, size)
+	binary.BigEndian.PutUint32(shard[0:4], uint32(len(chunk)))
+	copy(shard[4:], chunk)
+	return shard, nil
+}
+
+func fromShard(shard []byte) ([]byte, error) {
+	if len(shard) < 4 {
+		return nil, errors.New("shard too small")
+	}
+	n := binary.BigEndian.Uint32(shard[0:4])
+	if uint64(n) > uint64(len(shard)-4) {
+		return nil, errors.New("invalid length in shard")
+	}
+	return shard[4 : 4+n], nil
+}
+
+/* Compute the [m] parity chunks of a stripe made of the data chunks
+[chunks]. [k] is the number of data chunks of a full stripe */
+func EncodeStripe(chunks [][]byte, k int, m int) [][]byte {
+	size := 0
+	for _, chunk := range chunks {
+		if len(chunk)+4 > size {
+			size = len(chunk) + 4
+		}
+	}
+	parity := make([][]byte, m)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+	}
+	for j, chunk := range chunks {
+		shard, _ := toShard(chunk, size)
+		for i := range parity {
+			gfMulAdd(parity[i], erasureCoefficient(k, i, j), shard)
+		}
+	}
+	return parity
+}
+
+/* Recover the data chunks of a stripe. [data] and [parity] contain the
+chunks of the stripe we have, nil for the missing ones. [k] is the
+number of data chunks of a full stripe. Return every data chunk */
+func DecodeStripe(data [][]byte, parity [][]byte, k int) ([][]byte, error) {
+	missing := []int{}
+	for j, chunk := range data {
+		if chunk == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return data, nil
+	}
+
+	/* pick len(data) shards we have, data ones first since their rows
+	are trivial */
+	size := -1
+	for _, p := range parity {
+		if p != nil {
+			size = len(p)
+			break
+		}
+	}
+	if size == -1 {
+		return nil, errors.New("not enough chunks to recover the stripe")
+	}
+	n := len(data)
+	rows := [][]byte{}
+	shards := [][]byte{}
+	for j, chunk := range data {
+		if chunk != nil {
+			shard, err := toShard(chunk, size)
+			if err != nil {
+				return nil, err
+			}
+			row := make([]byte, n)
+			row[j] = 1
+			rows = append(rows, row)
+			shards = append(shards, shard)
+		}
+	}
+	for i, p := range parity {
+		if len(rows) == n {
+			break
+		}
+		if p == nil {
+			continue
+		}
+		if len(p) != size {
+			return nil, errors.New("parity chunks of different sizes")
+		}
+		row := make([]byte, n)
+		for j := range row {
+			row[j] = erasureCoefficient(k, i, j)
+		}
+		rows = append(rows, row)
+		shards = append(shards, p)
+	}
+	if len(rows) < n {
+		return nil, errors.New("not enough chunks to recover the stripe")
+	}
+
+	inverse, err := gfInvertMatrix(rows)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, n)
+	copy(out, data)
+	for _, j := range missing {
+		shard := make([]byte, size)
+		for r, coef := range inverse[j] {
+			gfMulAdd(shard, coef, shards[r])
+		}
+		chunk, err := fromShard(shard)
+		if err != nil {
+			return nil, err
+		}
+		out[j] = chunk
+	}
+	return out, nil
+}
+
+/* Group the [leaves] leaves of a metafile in stripes, following its
+header. Return nil if the file isn't erasure coded */
+func ErasureStripes(header MetaFileHeader, leaves int) ([]ErasureStripe, error) {
+	k := int(header.ErasureData)
+	m := int(header.ErasureParity)
+	if k == 0 {
+		return nil, nil
+	}
+	if m == 0 || k+m > ERASUREMAXSHARDS {
+		return nil, errors.New("invalid erasure coding parameters")
+	}
+	stripes := []ErasureStripe{}
+	for pos := 0; pos < leaves; {
+		remaining := leaves - pos
+		if remaining <= m {
+			return nil, errors.New("truncated stripe")
+		}
+		n := remaining - m
+		if n > k {
+			n = k
+		}
+		stripe := ErasureStripe{}
+		for j := 0; j < n; j++ {
+			stripe.Data = append(stripe.Data, pos+j)
+		}
+		for i := 0; i < m; i++ {
+			stripe.Parity = append(stripe.Parity, pos+n+i)
+		}
+		stripes = append(stripes, stripe)
+		pos += n + m
+	}
+	return stripes, nil
+}
+
+/* Hashes of the data chunks among the leaves [chunks], in order */
+func ErasureDataChunks(stripes []ErasureStripe, chunks [][]byte) [][]byte {
+	if stripes == nil {
+		return chunks
+	}
+	out := [][]byte{}
+	for _, stripe := range stripes {
+		for _, pos := range stripe.Data {
+			out = append(out, chunks[pos])
+		}
+	}
+	return out
+}
+
+/* Cut the data chunks of a file in stripes while it is being split:
+Add takes a data chunk and returns the parity chunks once a stripe is
+complete, Flush returns the ones of the last stripe */
+type erasureEncoder struct {
+	k      int
+	m      int
+	stripe [][]byte
+}
+
+func (e *erasureEncoder) Add(chunk []byte) [][]byte {
+	e.stripe = append(e.stripe, chunk)
+	if len(e.stripe) < e.k {
+		return nil
+	}
+	return e.Flush()
+}
+
+func (e *erasureEncoder) Flush() [][]byte {
+	if len(e.stripe) == 0 {
+		return nil
+	}
+	parity := EncodeStripe(e.stripe, e.k, e.m)
+	e.stripe = nil
+	return parity
+}
+
+/* Download an erasure coded file. [tasks] are the leaves we don't have
+yet:
+- the data chunks are fetched first, with only ERASUREDATAATTEMPTS
+attempts each
+- for the stripes where some could not be, the parity chunks are fetched
+- for the stripes which still miss chunks to be recovered, the missing
+data chunks are tried again with every attempt
+The parity chunks we didn't need are computed back from the data chunks,
+so that we end up with every leaf of the metafile, like the peer who
+shared the file.
+[fetch] gets a chunk and stores it, in at most the given number of
+attempts. [recovered] is called with every chunk rebuilt from the others,
+which is also written to the store.
+Return false if some data chunk can't be fetched nor recovered */
+func FetchErasureCoded(download *Download, stripes []ErasureStripe, chunks [][]byte, k int,
+	tasks []ChunkTask, fetch func(ChunkTask, int) bool, recovered func(ChunkTask, []byte)) bool {
+	lock := &sync.Mutex{}
+	have := make(map[int]bool)
+	for pos := range chunks {
+		have[pos] = true
+	}
+	for _, task := range tasks {
+		have[int(task.Id)-1] = false
+	}
+	/* a failed chunk doesn't stop the others, unless the download is
+	cancelled */
+	fetchAll := func(tasks []ChunkTask, attempts int) {
+		ScheduleChunks(tasks, func(task ChunkTask) bool {
+			if fetch(task, attempts) {
+				lock.Lock()
+				have[int(task.Id)-1] = true
+				lock.Unlock()
+			}
+			return !download.IsCancelled()
+		})
+	}
+
+	isParity := make(map[int]bool)
+	for _, stripe := range stripes {
+		for _, pos := range stripe.Parity {
+			isParity[pos] = true
+		}
+	}
+	/* keep the order chosen by the selection strategy */
+	data := []ChunkTask{}
+	for _, task := range tasks {
+		if !isParity[int(task.Id)-1] {
+			data = append(data, task)
+		}
+	}
+	fetchAll(data, ERASUREDATAATTEMPTS)
+	if download.IsCancelled() {
+		return false
+	}
+
+	/* the chunks of [positions] we don't have */
+	missingTasks := func(positions []int) []ChunkTask {
+		out := []ChunkTask{}
+		for _, pos := range positions {
+			if !have[pos] {
+				out = append(out, ChunkTask{Id: uint64(pos + 1), Hash: chunks[pos]})
+			}
+		}
+		return out
+	}
+	parity := []ChunkTask{}
+	for _, stripe := range stripes {
+		if len(missingTasks(stripe.Data)) > 0 {
+			parity = append(parity, missingTasks(stripe.Parity)...)
+		}
+	}
+	fetchAll(parity, DOWNLOADRETRIES)
+	if download.IsCancelled() {
+		return false
+	}
+
+	retry := []ChunkTask{}
+	for _, stripe := range stripes {
+		missing := missingTasks(append(append([]int{}, stripe.Data...), stripe.Parity...))
+		if len(missing) > len(stripe.Parity) {
+			retry = append(retry, missingTasks(stripe.Data)...)
+		}
+	}
+	fetchAll(retry, DOWNLOADRETRIES)
+	if download.IsCancelled() {
+		return false
+	}
+
+	read := func(pos int) []byte {
+		if !have[pos] {
+			return nil
+		}
+		kind, content := ChunkStorage().Get(chunks[pos])
+		if kind == NoFileId {
+			return nil
+		}
+		return content
+	}
+	store := func(pos int, chunk []byte) bool {
+		hash := sha256.Sum256(chunk)
+		if !bytes.Equal(hash[:], chunks[pos]) {
+			download.AddError("recovered chunk " + HashToUid(chunks[pos]) + " is invalid")
+			return false
+		}
+		WriteChunkFile(chunk)
+		recovered(ChunkTask{Id: uint64(pos + 1), Hash: chunks[pos]}, chunk)
+		return true
+	}
+	for _, stripe := range stripes {
+		dataChunks := make([][]byte, len(stripe.Data))
+		missing := false
+		for j, pos := range stripe.Data {
+			dataChunks[j] = read(pos)
+			missing = missing || dataChunks[j] == nil
+		}
+		missingParity := false
+		for _, pos := range stripe.Parity {
+			missingParity = missingParity || !have[pos]
+		}
+		if missing {
+			parityChunks := make([][]byte, len(stripe.Parity))
+			for i, pos := range stripe.Parity {
+				parityChunks[i] = read(pos)
+			}
+			decoded, err := DecodeStripe(dataChunks, parityChunks, k)
+			if err != nil {
+				download.AddError(err.Error())
+				return false
+			}
+			for j, pos := range stripe.Data {
+				if dataChunks[j] == nil && !store(pos, decoded[j]) {
+					return false
+				}
+			}
+			dataChunks = decoded
+		}
+		if missingParity {
+			parityChunks := EncodeStripe(dataChunks, k, len(stripe.Parity))
+			for i, pos := range stripe.Parity {
+				if !have[pos] && !store(pos, parityChunks[i]) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+)
+
+func erasureTestChunks(r *rand.Rand, n int) [][]byte {
+	chunks := [][]byte{}
+	for i := 0; i < n; i++ {
+		/* chunks of different sizes, including an empty one */
+		chunk := make([]byte, r.Intn(200))
+		r.Read(chunk)
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+/* Try to decode after losing every subset of the chunks of a stripe of
+[n] data chunks, [k] being the size of a full stripe */
+func testEveryErasure(t *testing.T, r *rand.Rand, n int, k int, m int) {
+	data := erasureTestChunks(r, n)
+	parity := EncodeStripe(data, k, m)
+	if len(parity) != m {
+		t.Fatalf("%d parity chunks instead of %d", len(parity), m)
+	}
+	total := n + m
+	for lost := 0; lost < 1<<uint(total); lost++ {
+		received := make([][]byte, n)
+		receivedParity := make([][]byte, m)
+		count := 0
+		for j := 0; j < total; j++ {
+			if lost&(1<<uint(j)) != 0 {
+				continue
+			}
+			count += 1
+			if j < n {
+				received[j] = data[j]
+			} else {
+				receivedParity[j-n] = parity[j-n]
+			}
+		}
+		decoded, err := DecodeStripe(received, receivedParity, k)
+		if count < n {
+			if err == nil {
+				t.Fatalf("k=%d m=%d n=%d: decoded with %d chunks", k, m, n, count)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("k=%d m=%d n=%d lost=%b: %s", k, m, n, lost, err)
+		}
+		for j := range data {
+			if !bytes.Equal(decoded[j], data[j]) {
+				t.Fatalf("k=%d m=%d n=%d lost=%b: chunk %d differs", k, m, n, lost, j)
+			}
+		}
+	}
+}
+
+func TestErasureEveryPattern(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for k := 1; k <= 5; k++ {
+		for m := 1; m <= 4; m++ {
+			/* the last stripe of a file may be shorter */
+			for n := 1; n <= k; n++ {
+				testEveryErasure(t, r, n, k, m)
+			}
+		}
+	}
+}
+
+func TestErasureBigParameters(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	k, m := 200, ERASUREMAXSHARDS-200
+	data := erasureTestChunks(r, k)
+	parity := EncodeStripe(data, k, m)
+	received := make([][]byte, k)
+	copy(received, data)
+	/* lose as many data chunks as there are parity chunks */
+	for _, j := range r.Perm(k)[:m] {
+		received[j] = nil
+	}
+	decoded, err := DecodeStripe(received, parity, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for j := range data {
+		if !bytes.Equal(decoded[j], data[j]) {
+			t.Fatalf("chunk %d differs", j)
+		}
+	}
+}
+
+func TestErasureParamsByName(t *testing.T) {
+	valid := map[string][2]int{"": {0, 0}, "off": {0, 0}, "4,2": {4, 2}, "1,1": {1, 1}}
+	for name, params := range valid {
+		k, m, ok := ErasureParamsByName(name)
+		if !ok || k != params[0] || m != params[1] {
+			t.Fatalf("%q gives %d,%d,%v", name, k, m, ok)
+		}
+	}
+	for _, name := range []string{"4", "0,2", "4,0", "a,b", "4,2,1", "200,57"} {
+		if _, _, ok := ErasureParamsByName(name); ok {
+			t.Fatalf("%q accepted", name)
+		}
+	}
+}
+
+func TestErasureStripes(t *testing.T) {
+	header := MetaFileHeader{ErasureData: 3, ErasureParity: 2}
+	/* two full stripes and one of 1 data chunk */
+	stripes, err := ErasureStripes(header, 5+5+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stripes) != 3 {
+		t.Fatalf("%d stripes", len(stripes))
+	}
+	last := stripes[2]
+	if len(last.Data) != 1 || last.Data[0] != 10 || len(last.Parity) != 2 || last.Parity[1] != 12 {
+		t.Fatalf("last stripe %+v", last)
+	}
+	leaves := metaFileTestHashes(13)
+	data := ErasureDataChunks(stripes, leaves)
+	if len(data) != 7 || !bytes.Equal(data[3], leaves[5]) {
+		t.Fatal("wrong data chunks")
+	}
+	if _, err := ErasureStripes(header, 5+2); err == nil {
+		t.Fatal("stripe without data chunk accepted")
+	}
+	if stripes, err := ErasureStripes(MetaFileHeader{}, 4); stripes != nil || err != nil {
+		t.Fatal("stripes without erasure coding")
+	}
+}
+
+/* A data chunk failing once makes the parity chunks of its stripe be
+fetched, and is only tried again when the stripe can't be recovered */
+func TestFetchErasureCoded(t *testing.T) {
+	folder, err := ioutil.TempDir("", "erasure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	previous := TEMPFOLDER
+	TEMPFOLDER = folder + "/"
+	defer func() { TEMPFOLDER = previous }()
+
+	k, m := 3, 2
+	r := rand.New(rand.NewSource(3))
+	data := erasureTestChunks(r, 7)
+	leaves := [][]byte{}
+	content := make(map[string][]byte)
+	add := func(chunk []byte) {
+		hash := sha256.Sum256(chunk)
+		leaves = append(leaves, hash[:])
+		content[string(hash[:])] = chunk
+	}
+	for start := 0; start < len(data); start += k {
+		end := start + k
+		if end > len(data) {
+			end = len(data)
+		}
+		for _, chunk := range data[start:end] {
+			add(chunk)
+		}
+		for _, chunk := range EncodeStripe(data[start:end], k, m) {
+			add(chunk)
+		}
+	}
+	stripes, err := ErasureStripes(MetaFileHeader{ErasureData: uint8(k), ErasureParity: uint8(m)}, len(leaves))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks := []ChunkTask{}
+	for i, hash := range leaves {
+		tasks = append(tasks, ChunkTask{Id: uint64(i + 1), Hash: hash})
+	}
+
+	/* leaves counted starting 1: the first stripe is 1-5, its data 1-3.
+	The second stripe (6-10) loses 3 chunks out of 5: chunk 7 has to be
+	tried again, and then answers */
+	lost := map[uint64]bool{1: true, 2: true, 7: true, 9: true, 10: true}
+	attempts := make(map[uint64][]int)
+	var lock sync.Mutex
+	fetch := func(task ChunkTask, n int) bool {
+		lock.Lock()
+		attempts[task.Id] = append(attempts[task.Id], n)
+		lock.Unlock()
+		if lost[task.Id] && !(task.Id == 7 && n == DOWNLOADRETRIES) {
+			return false
+		}
+		WriteChunkFile(content[string(task.Hash)])
+		return true
+	}
+	recovered := 0
+	ok := FetchErasureCoded(NewDownload("test", "test"), stripes, leaves, k, tasks, fetch,
+		func(task ChunkTask, chunk []byte) { recovered += 1 })
+	if !ok {
+		t.Fatal("download failed")
+	}
+	for i, hash := range leaves {
+		if _, ok := readVerifiedHash(hash); !ok {
+			t.Fatalf("leaf %d missing", i+1)
+		}
+	}
+	if len(attempts[1]) != 1 || attempts[1][0] != ERASUREDATAATTEMPTS {
+		t.Fatalf("attempts for a recoverable data chunk: %v", attempts[1])
+	}
+	if len(attempts[7]) != 2 || attempts[7][1] != DOWNLOADRETRIES {
+		t.Fatalf("attempts for an unrecoverable data chunk: %v", attempts[7])
+	}
+	/* parity of a complete stripe is computed, not fetched */
+	if len(attempts[12]) != 0 || len(attempts[13]) != 0 {
+		t.Fatal("parity of a complete stripe fetched")
+	}
+	/* 2 data chunks rebuilt, and the parity of the 2 other stripes */
+	if recovered != 2+2+2 {
+		t.Fatalf("%d chunks recovered", recovered)
+	}
+}
@@ -3,10 +3,12 @@ package lib
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
 )
 
@@ -21,7 +23,7 @@ func HashToUid(hash []byte) string {
 }
 
 func UidIsValidHash(uid string) bool {
-	out, _ := regexp.MatchString("[a-f0-9A-F]{64}", uid)
+	out, _ := regexp.MatchString("^[a-f0-9A-F]{64}$", uid)
 	return out
 }
 
@@ -33,29 +35,53 @@ var DOWNLOADFOLDER string = "_Downloads/"
 func InitializeTempDir(server_name string) {
 	TEMPFOLDER = "_tmp_" + server_name + "/"
 	os.MkdirAll(TEMPFOLDER, os.ModePerm)
+	ChunkStorage()
 }
 
-/* TODO: launch several goroutines reading separate chunk of the file
+/* Split the file in chunks, stored in the temporary folder.
+Return the root metafile, the hashes of the chunks (parity chunks
+included) and the size of the file. Sub metafiles, if any, are written
+to the temporary folder but not the root one.
+TODO: launch several goroutines reading separate chunk of the file
 to go faster */
-func SplitFile(file_name string) ([]byte, int64) {
+func SplitFile(file_name string) ([]byte, [][]byte, int64) {
 	file, err := os.Open(SHAREDFOLDER + file_name)
 	if err != nil {
 		fmt.Println(err)
-		return []byte{}, 0
+		return []byte{}, [][]byte{}, 0
 	}
 	defer file.Close()
 
-	buffer := make([]byte, FILECHUNKSIZE)
+	return SplitReader(file, MetaKindFile)
+}
 
-	metafile := []byte{}
+/* Same as SplitFile, for any content. [kind] is recorded in the
+metafile, as well as the chunking mode (CHUNKINGMODE).
+With erasure coding (ERASUREDATA > 0) the parity chunks are computed too,
+and the hashes returned are the ones of every leaf of the metafile.
+The chunks and sub metafiles are pinned in the chunk store, so that they
+aren't evicted before being shared: registerFile unpins them */
+func SplitReader(reader io.Reader, kind uint8) ([]byte, [][]byte, int64) {
+	chunker := NewChunker(reader, CHUNKINGMODE)
 
-	filesize := int64(0)
+	chunks := [][]byte{}
 
-	for {
-		bytesread, err := file.Read(buffer)
+	filesize := int64(0)
 
-		filesize += int64(bytesread)
+	var encoder *erasureEncoder
+	if ERASUREDATA > 0 {
+		encoder = &erasureEncoder{k: ERASUREDATA, m: ERASUREPARITY}
+	}
+	writeParity := func(parity [][]byte) {
+		for _, p := range parity {
+			uid := WriteChunkFile(p)
+			ChunkStorage().Pin(uid)
+			chunks = append(chunks, UidToHash(uid))
+		}
+	}
 
+	for {
+		chunk, err := chunker.Next()
 		if err != nil {
 			if err != io.EOF {
 				fmt.Println(err)
@@ -63,24 +89,50 @@ func SplitFile(file_name string) ([]byte, int64) {
 			break
 		}
 
-		hash := sha256.Sum256(buffer[:bytesread])
-		metafile = append(metafile, hash[:]...)
-		uid := HashToUid(hash[:])
+		filesize += int64(len(chunk))
 
-		if _, err := os.Stat(TEMPFOLDER + uid); os.IsNotExist(err) {
-			chunk_file, err := os.Create(TEMPFOLDER + uid)
-			if err != nil {
-				fmt.Println(err)
-			} else {
-				chunk_file.Write(buffer[:bytesread])
-			}
-			chunk_file.Close()
+		uid := WriteChunkFile(chunk)
+		ChunkStorage().Pin(uid)
+		chunks = append(chunks, UidToHash(uid))
+		if encoder != nil {
+			writeParity(encoder.Add(chunk))
 		}
 	}
-	return metafile, filesize
+
+	header := MetaFileHeader{
+		Kind:     kind,
+		Chunking: CHUNKINGMODE,
+		Size:     uint64(filesize),
+	}
+	if encoder != nil {
+		writeParity(encoder.Flush())
+		header.ErasureData = uint8(ERASUREDATA)
+		header.ErasureParity = uint8(ERASUREPARITY)
+	}
+	metafile, subs := BuildMetaFile(header, chunks)
+	for _, sub := range subs {
+		ChunkStorage().Pin(WriteMetaFile(sub))
+	}
+	return metafile, chunks, filesize
+}
+
+/* Read the content of the chunks whose hashes are [chunks] */
+func ReadChunks(chunks [][]byte) ([]byte, error) {
+	out := []byte{}
+	for _, hash := range chunks {
+		kind, chunk := ChunkStorage().Get(hash)
+		if kind == NoFileId {
+			return nil, errors.New("missing chunk " + HashToUid(hash))
+		}
+		out = append(out, chunk...)
+	}
+	return out, nil
 }
 
-func ReconstructFile(out_file string, metafile []byte) {
+/* Concatenate the chunks whose hashes are [chunks]. Chunks are read
+entirely, so they may have any size */
+func ReconstructFile(out_file string, chunks [][]byte) {
+	os.MkdirAll(filepath.Dir(DOWNLOADFOLDER+out_file), os.ModePerm)
 	file, err := os.Create(DOWNLOADFOLDER + out_file)
 	defer file.Close()
 
@@ -91,19 +143,13 @@ func ReconstructFile(out_file string, metafile []byte) {
 		return
 	}
 
-	for i := 0; i < len(metafile); i += 32 {
-		hash := metafile[i : i+32]
-		uid := HashToUid(hash)
-
-		chunk_file, err := os.Open(TEMPFOLDER + uid)
-		if err != nil {
-			fmt.Println(err)
+	for _, hash := range chunks {
+		kind, chunk := ChunkStorage().Get(hash)
+		if kind == NoFileId {
+			fmt.Println("missing chunk", HashToUid(hash))
 		} else {
-			chunk_buffer := make([]byte, FILECHUNKSIZE)
-			bytesread, _ := chunk_file.Read(chunk_buffer)
-			file.Write(chunk_buffer[:bytesread])
+			file.Write(chunk)
 		}
-		chunk_file.Close()
 	}
 }
 func WriteFile(name string, data []byte) {
@@ -121,15 +167,13 @@ func GetMetaHash(metafile []byte) string {
 	return HashToUid(hash[:])
 }
 
-func WriteMetaFile(metafile []byte) {
-	uid := GetMetaHash(metafile)
-	WriteFile(TEMPFOLDER+uid+".meta", metafile)
+/* Chunks and metafiles are stored in the chunk store. Return their hash */
+func WriteMetaFile(metafile []byte) string {
+	return ChunkStorage().Put(metafile, true)
 }
 
-func WriteChunkFile(chunk []byte) {
-	hash := sha256.Sum256(chunk)
-	uid := HashToUid(hash[:])
-	WriteFile(TEMPFOLDER+uid, chunk)
+func WriteChunkFile(chunk []byte) string {
+	return ChunkStorage().Put(chunk, false)
 }
 
 func ReadAllFile(filename string) []byte {
@@ -149,11 +193,5 @@ const (
 )
 
 func ReadFileForHash(hash []byte) (int, []byte) {
-	uid := HashToUid(hash)
-	if _, err := os.Stat(TEMPFOLDER + uid + ".meta"); !os.IsNotExist(err) {
-		return MetaFileId, ReadAllFile(TEMPFOLDER + uid + ".meta")
-	} else if _, err := os.Stat(TEMPFOLDER + uid); !os.IsNotExist(err) {
-		return ChunkFileId, ReadAllFile(TEMPFOLDER + uid)
-	}
-	return NoFileId, []byte{}
+	return ChunkStorage().Get(hash)
 }
@@ -1,8 +1,8 @@
 package lib
 
 import (
-	"math/rand"
 	"sync"
+	"time"
 )
 
 /* Manage chunks known to be stored on distant (including our) node */
@@ -18,6 +18,9 @@ type FileKnowledgeDB struct {
 	lock *sync.Mutex
 	/* map of metafile -> chunk_id -> map of peers */
 	db map[string]*FileKnowledgeInfo
+	/* map of metafile -> peers who sent us corrupted data for this file */
+	blacklist map[string](map[string]bool)
+	strategy  SelectionStrategy
 }
 
 func NewFileKnowledgeInfo() *FileKnowledgeInfo {
@@ -45,7 +48,12 @@ func (k *FileKnowledgeInfo) Insert(chunkId int, peer string) {
 }
 
 func NewFileKnowledgeDB() *FileKnowledgeDB {
-	return &FileKnowledgeDB{db: make(map[string]*FileKnowledgeInfo), lock: &sync.Mutex{}}
+	return &FileKnowledgeDB{
+		db:        make(map[string]*FileKnowledgeInfo),
+		blacklist: make(map[string](map[string]bool)),
+		strategy:  NewSwarmStrategy(),
+		lock:      &sync.Mutex{},
+	}
 }
 
 func (fk *FileKnowledgeDB) Insert(metahash string, chunkId int, peer string) {
@@ -59,32 +67,107 @@ func (fk *FileKnowledgeDB) Insert(metahash string, chunkId int, peer string) {
 	fk.db[metahash].Insert(chunkId, peer)
 }
 
-func (fk *FileKnowledgeDB) SelectPeerForMetaHash(peer string, metahash string) string {
-	if peer != "" {
-		return peer
+/* Return true if we know at least one peer having this metafile */
+func (fk *FileKnowledgeDB) KnowsMetaHash(metahash string) bool {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+
+	entry, ok := fk.db[metahash]
+	return ok && len(entry.peersHavingMetahash) > 0
+}
+
+/* Never select [peer] again to download [metahash] */
+func (fk *FileKnowledgeDB) Blacklist(metahash string, peer string) {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+
+	if _, ok := fk.blacklist[metahash]; !ok {
+		fk.blacklist[metahash] = make(map[string]bool)
 	}
+	fk.blacklist[metahash][peer] = true
+}
+
+func (fk *FileKnowledgeDB) SetStrategy(strategy SelectionStrategy) {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+
+	fk.strategy = strategy
+}
+
+/* Order the chunks of [metahash] to download using the strategy */
+func (fk *FileKnowledgeDB) OrderChunks(metahash string, tasks []ChunkTask) []ChunkTask {
 	fk.lock.Lock()
 	defer fk.lock.Unlock()
 
+	holders := make(map[uint64]int)
 	if entry, ok := fk.db[metahash]; ok {
-		return entry.peersHavingMetahash[rand.Intn(len(entry.peersHavingMetahash))]
-	} else {
-		return peer
+		for _, task := range tasks {
+			holders[task.Id] = len(entry.peersHavingChunk[int(task.Id)])
+		}
+	}
+	return fk.strategy.OrderChunks(tasks, holders)
+}
+
+/* Tell the strategy that [peer] answered a request for [metahash] */
+func (fk *FileKnowledgeDB) OnReply(metahash string, peer string, rtt time.Duration) {
+	fk.lock.Lock()
+	strategy := fk.strategy
+	fk.lock.Unlock()
+
+	strategy.OnReply(metahash, peer, rtt)
+}
+
+/* Tell the strategy that a request for [metahash] sent to [peer] is over */
+func (fk *FileKnowledgeDB) OnRequestDone(metahash string, peer string) {
+	fk.lock.Lock()
+	strategy := fk.strategy
+	fk.lock.Unlock()
+
+	strategy.OnRequestDone(metahash, peer)
+}
+
+/* Select a peer among [candidates] which isn't blacklisted for
+[metahash] nor in [avoid] using the strategy.
+Must be called with the lock held */
+func (fk *FileKnowledgeDB) selectAllowedPeer(metahash string, candidates []string, avoid map[string]bool) string {
+	allowed := []string{}
+	for _, p := range candidates {
+		if !fk.blacklist[metahash][p] && !avoid[p] {
+			allowed = append(allowed, p)
+		}
+	}
+	if len(allowed) == 0 {
+		return ""
 	}
+	return fk.strategy.SelectPeer(metahash, allowed)
 }
 
-func (fk *FileKnowledgeDB) SelectPeerForChunk(peer string, metahash string, chunkId int) string {
-	if peer != "" {
+/* If [peer] is given, trusted and not in [avoid] it is used. Otherwise,
+we select a peer having this metafile. Return "" if there is no such peer */
+func (fk *FileKnowledgeDB) SelectPeerForMetaHash(peer string, metahash string, avoid map[string]bool) string {
+	fk.lock.Lock()
+	defer fk.lock.Unlock()
+
+	if peer != "" && !fk.blacklist[metahash][peer] && !avoid[peer] {
 		return peer
 	}
+	if entry, ok := fk.db[metahash]; ok {
+		return fk.selectAllowedPeer(metahash, entry.peersHavingMetahash, avoid)
+	}
+	return ""
+}
+
+func (fk *FileKnowledgeDB) SelectPeerForChunk(peer string, metahash string, chunkId int, avoid map[string]bool) string {
 	fk.lock.Lock()
 	defer fk.lock.Unlock()
 
+	if peer != "" && !fk.blacklist[metahash][peer] && !avoid[peer] {
+		return peer
+	}
 	if entryM, ok := fk.db[metahash]; ok {
 		if entry, ok := entryM.peersHavingChunk[chunkId]; ok {
-			return entry[rand.Intn(len(entry))]
-
+			return fk.selectAllowedPeer(metahash, entry, avoid)
 		}
 	}
-	return peer
+	return ""
 }
@@ -4,30 +4,44 @@ package lib
 
 import (
 	"regexp"
+	"strings"
 	"sync"
 )
 
-type chunkEntry struct {
-	chunks []string
-}
-
 type metaFileInformation struct {
 	hash  string
 	count uint64
+	/* true for the files we share ourselves, false for the downloaded ones */
+	owned bool
+}
+
+/* Every file of the manager references its metafile, sub metafiles and
+chunks in the chunk store. A file shared by us also pins them, so that
+they are never evicted */
+type fileEntry struct {
+	chunks    map[string]uint64
+	metafiles []string
+	/* number of names of this file, and how many are owned */
+	names  int
+	owners int
 }
 
 type FileManager struct {
-	lock        *sync.Mutex
-	fileToUid   map[string]metaFileInformation
-	uidToChunks map[string](map[string]uint64)
+	lock      *sync.Mutex
+	fileToUid map[string]metaFileInformation
+	files     map[string]*fileEntry
+	store     *ChunkStore
 }
 
 func NewFileManager() *FileManager {
-	return &FileManager{
-		fileToUid:   make(map[string]metaFileInformation),
-		uidToChunks: make(map[string](map[string]uint64)),
-		lock:        &sync.Mutex{},
+	fm := &FileManager{
+		fileToUid: make(map[string]metaFileInformation),
+		files:     make(map[string]*fileEntry),
+		store:     ChunkStorage(),
+		lock:      &sync.Mutex{},
 	}
+	fm.store.SetEvictCallback(fm.ForgetHashes)
+	return fm
 }
 
 func (fm *FileManager) toSearchReply(pattern *regexp.Regexp) [](*SearchResult) {
@@ -39,7 +53,7 @@ func (fm *FileManager) toSearchReply(pattern *regexp.Regexp) [](*SearchResult) {
 	for fileName, metafile := range fm.fileToUid {
 		if FilenameMatchPattern(pattern, fileName) {
 			chunkMap := []uint64{}
-			for _, pos := range fm.uidToChunks[metafile.hash] {
+			for _, pos := range fm.files[metafile.hash].chunks {
 				chunkMap = append(chunkMap, pos)
 			}
 			result := &SearchResult{
@@ -54,29 +68,173 @@ func (fm *FileManager) toSearchReply(pattern *regexp.Regexp) [](*SearchResult) {
 	return out
 }
 
+/* Every hash used by [entry], including the metahash [hash] */
+func (entry *fileEntry) hashes(hash string) []string {
+	out := []string{hash}
+	out = append(out, entry.metafiles...)
+	for chunk := range entry.chunks {
+		out = append(out, chunk)
+	}
+	return out
+}
+
+/* Must be called with the lock held */
+func (fm *FileManager) getEntry(hash string) *fileEntry {
+	if entry, ok := fm.files[hash]; ok {
+		return entry
+	}
+	entry := &fileEntry{
+		chunks:    make(map[string]uint64),
+		metafiles: []string{},
+	}
+	fm.files[hash] = entry
+	fm.store.Ref(hash)
+	return entry
+}
+
+/* Must be called with the lock held */
+func (fm *FileManager) addFile(name string, hash string, count uint64, owned bool) {
+	fm.removeFile(name)
+	entry := fm.getEntry(hash)
+	entry.names += 1
+	if owned {
+		entry.owners += 1
+		if entry.owners == 1 {
+			for _, h := range entry.hashes(hash) {
+				fm.store.Pin(h)
+			}
+		}
+	}
+	fm.fileToUid[name] = metaFileInformation{hash: hash, count: count, owned: owned}
+}
+
+/* Add a file we are downloading */
 func (fm *FileManager) AddFile(name string, hash string, count uint64) {
 	fm.lock.Lock()
 	defer fm.lock.Unlock()
-	if _, ok := fm.uidToChunks[hash]; !ok {
-		fm.uidToChunks[hash] = make(map[string]uint64)
-	}
-	fm.fileToUid[name] = metaFileInformation{hash: hash, count: count}
+	fm.addFile(name, hash, count, false)
+}
+
+/* Add a file we share ourselves */
+func (fm *FileManager) ShareFile(name string, hash string, count uint64) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	fm.addFile(name, hash, count, true)
 }
 
 func (fm *FileManager) AddChunk(hash_file string, hash_chunk string, chunkPos uint64) {
 	fm.lock.Lock()
 	defer fm.lock.Unlock()
-	if _, ok := fm.uidToChunks[hash_file]; !ok {
-		fm.uidToChunks[hash_file] = make(map[string]uint64)
+	entry := fm.getEntry(hash_file)
+	if _, ok := entry.chunks[hash_chunk]; !ok {
+		fm.store.Ref(hash_chunk)
+		if entry.owners > 0 {
+			fm.store.Pin(hash_chunk)
+		}
+	}
+	entry.chunks[hash_chunk] = chunkPos
+}
+
+/* Record the sub metafiles of the tree metafile [hash_file] */
+func (fm *FileManager) AddMetaFiles(hash_file string, metafiles [][]byte) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	entry := fm.getEntry(hash_file)
+	for _, m := range metafiles {
+		uid := HashToUid(m)
+		fm.store.Ref(uid)
+		if entry.owners > 0 {
+			fm.store.Pin(uid)
+		}
+		entry.metafiles = append(entry.metafiles, uid)
+	}
+}
+
+/* Must be called with the lock held */
+func (fm *FileManager) removeFile(name string) bool {
+	info, ok := fm.fileToUid[name]
+	if !ok {
+		return false
+	}
+	delete(fm.fileToUid, name)
+	entry := fm.files[info.hash]
+	hashes := entry.hashes(info.hash)
+	if info.owned {
+		entry.owners -= 1
+		if entry.owners == 0 {
+			for _, h := range hashes {
+				fm.store.Unpin(h)
+			}
+		}
+	}
+	entry.names -= 1
+	if entry.names == 0 {
+		for _, h := range hashes {
+			fm.store.Unref(h)
+		}
+		delete(fm.files, info.hash)
+	}
+	return true
+}
+
+/* Stop sharing [name]. For a directory, every file inside it is also
+removed. Return the names removed */
+func (fm *FileManager) RemoveFile(name string) []string {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+
+	removed := []string{}
+	if fm.removeFile(name) {
+		removed = append(removed, name)
+	}
+	dir := DirectoryDisplayName(name)
+	if fm.removeFile(dir) {
+		removed = append(removed, dir)
+		for other := range fm.fileToUid {
+			if strings.HasPrefix(other, dir) && fm.removeFile(other) {
+				removed = append(removed, other)
+			}
+		}
+	}
+	return removed
+}
+
+/* The store evicted [uids]: we can't serve them anymore. A file whose
+metafile is evicted is forgotten */
+func (fm *FileManager) ForgetHashes(uids []string) {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+
+	evicted := make(map[string]bool)
+	for _, uid := range uids {
+		evicted[uid] = true
+	}
+	for hash, entry := range fm.files {
+		for chunk := range entry.chunks {
+			if evicted[chunk] {
+				delete(entry.chunks, chunk)
+				fm.store.Unref(chunk)
+			}
+		}
+		lost := evicted[hash]
+		for _, m := range entry.metafiles {
+			lost = lost || evicted[m]
+		}
+		if lost {
+			for name, info := range fm.fileToUid {
+				if info.hash == hash {
+					fm.removeFile(name)
+				}
+			}
+		}
 	}
-	fm.uidToChunks[hash_file][hash_chunk] = chunkPos
 }
 
 func (fm *FileManager) GetChunksFromFilename(filename string) []string {
 	fm.lock.Lock()
 	defer fm.lock.Unlock()
 	if metaFile, ok := fm.fileToUid[filename]; ok {
-		chunks := fm.uidToChunks[metaFile.hash]
+		chunks := fm.files[metaFile.hash].chunks
 		out := []string{}
 		for k := range chunks {
 			out = append(out, k)
@@ -86,3 +244,12 @@ func (fm *FileManager) GetChunksFromFilename(filename string) []string {
 		return []string{}
 	}
 }
+
+/* Return true if [hash] is the metahash of a file we share, even
+partially */
+func (fm *FileManager) HasMetaHash(hash string) bool {
+	fm.lock.Lock()
+	defer fm.lock.Unlock()
+	_, ok := fm.files[hash]
+	return ok
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"errors"
+)
+
+/* Arithmetic in the Galois field GF(2^8), used by the Reed-Solomon code
+of erasure.go. Additions are xors, multiplications are done with the
+tables of logarithms and exponentials of the generator 2, modulo the
+polynomial x^8 + x^4 + x^3 + x^2 + 1 */
+
+const gfPolynomial int = 0x11d
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+/* gfMulTable[a][b] = a * b, faster than going through the logarithms
+when encoding a whole chunk */
+var gfMulTable [256][256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	/* so that gfExp[log a + log b] never needs a modulo */
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			gfMulTable[a][b] = gfMul(byte(a), byte(b))
+		}
+	}
+}
+
+func gfMul(a byte, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+/* b must not be 0 */
+func gfInv(b byte) byte {
+	return gfExp[255-int(gfLog[b])]
+}
+
+/* out += coef * in, for every byte */
+func gfMulAdd(out []byte, coef byte, in []byte) {
+	if coef == 0 {
+		return
+	}
+	row := &gfMulTable[coef]
+	for i, b := range in {
+		out[i] ^= row[b]
+	}
+}
+
+/* Invert the square matrix [m] by a Gauss-Jordan elimination. [m] is
+not modified */
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	/* [work | out], out starting as the identity */
+	work := make([][]byte, n)
+	out := make([][]byte, n)
+	for i := range m {
+		work[i] = append([]byte{}, m[i]...)
+		out[i] = make([]byte, n)
+		out[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if work[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+		out[col], out[pivot] = out[pivot], out[col]
+
+		inv := gfInv(work[col][col])
+		for j := 0; j < n; j++ {
+			work[col][j] = gfMul(work[col][j], inv)
+			out[col][j] = gfMul(out[col][j], inv)
+		}
+		for row := 0; row < n; row++ {
+			if row != col && work[row][col] != 0 {
+				coef := work[row][col]
+				gfMulAdd(work[row], coef, work[col])
+				gfMulAdd(out[row], coef, out[col])
+			}
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"math/rand"
+	"testing"
+)
+
+/* Multiplication without the tables: shift and add, modulo the
+polynomial */
+func gfMulSlow(a byte, b byte) byte {
+	x, y := int(a), int(b)
+	out := 0
+	for y > 0 {
+		if y&1 != 0 {
+			out ^= x
+		}
+		y >>= 1
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPolynomial
+		}
+	}
+	return byte(out)
+}
+
+func TestGfMul(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 0; b < 256; b++ {
+			if gfMul(byte(a), byte(b)) != gfMulSlow(byte(a), byte(b)) {
+				t.Fatalf("%d * %d", a, b)
+			}
+			if gfMulTable[a][b] != gfMul(byte(a), byte(b)) {
+				t.Fatalf("table for %d * %d", a, b)
+			}
+		}
+	}
+}
+
+func TestGfInv(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("inverse of %d", a)
+		}
+	}
+}
+
+func TestGfMulAdd(t *testing.T) {
+	in := make([]byte, 100)
+	rand.New(rand.NewSource(1)).Read(in)
+	out := make([]byte, 100)
+	copy(out, in)
+	gfMulAdd(out, 7, in)
+	for i := range in {
+		if out[i] != in[i]^gfMul(7, in[i]) {
+			t.Fatalf("byte %d", i)
+		}
+	}
+	gfMulAdd(out, 0, in)
+	for i := range in {
+		if out[i] != in[i]^gfMul(7, in[i]) {
+			t.Fatal("a multiplication by 0 changed the output")
+		}
+	}
+}
+
+func TestGfInvertMatrix(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for n := 1; n <= 8; n++ {
+		m := make([][]byte, n)
+		for i := range m {
+			m[i] = make([]byte, n)
+			r.Read(m[i])
+		}
+		inverse, err := gfInvertMatrix(m)
+		if err != nil {
+			/* a random matrix may be singular */
+			continue
+		}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				var sum byte
+				for k := 0; k < n; k++ {
+					sum ^= gfMul(m[i][k], inverse[k][j])
+				}
+				if (i == j && sum != 1) || (i != j && sum != 0) {
+					t.Fatalf("m * m^-1 isn't the identity for n = %d", n)
+				}
+			}
+		}
+	}
+}
+
+func TestGfInvertSingularMatrix(t *testing.T) {
+	m := [][]byte{{1, 2}, {2, 4}}
+	if _, err := gfInvertMatrix(m); err == nil {
+		t.Fatal("singular matrix inverted")
+	}
+}
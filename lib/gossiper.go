@@ -1,12 +1,14 @@
 package lib
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"github.com/dedis/protobuf"
+	"math/big"
 	"math/rand"
 	"net"
+	"os"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -22,6 +24,13 @@ type Gossiper struct {
 	SimpleMode bool
 
 	Rtimer int
+
+	/* used to sign our transactions */
+	Key ed25519.PrivateKey
+
+	/* connection the client talks to, used to answer its queries.
+	nil when using the web frontend */
+	ClientConn *net.UDPConn
 }
 
 /* return elements starting at 1 as it returns the new value */
@@ -29,8 +38,21 @@ func (gossip *Gossiper) NewMsgId() uint32 {
 	return atomic.AddUint32(gossip.CurrentMsgId, 1)
 }
 
+/* After a restart, continue numbering our messages after the last one
+we stored. Otherwise we would reuse ids other peers already know */
+func (gossip *Gossiper) RestoreMsgId(state *State) {
+	atomic.StoreUint32(gossip.CurrentMsgId, state.db.GetLastId(gossip.Name))
+}
+
+/* Load the key pair of the node, or create it on the first launch */
+func (gossip *Gossiper) LoadIdentity() error {
+	key, err := LoadOrCreateKey(TEMPFOLDER + "identity.key")
+	gossip.Key = key
+	return err
+}
+
 func (gossip *Gossiper) Receive(c NetChannel) error {
-	buffer := make([]byte, 65536)
+	buffer := make([]byte, UDPBUFFERSIZE)
 	bytes_read, address, err := gossip.Conn.ReadFromUDP(buffer)
 
 	if err != nil {
@@ -119,6 +141,22 @@ func (server *Gossiper) ClientHandler(state *State, request Packet) {
 			packet.DataReply.Origin)
 	} else if packet.SearchRequest != nil {
 		go server.LaunchSearch(state, packet.SearchRequest.Keywords, int(packet.SearchRequest.Budget))
+	} else if packet.DownloadControl != nil {
+		answer := state.Downloads.HandleControl(packet.DownloadControl)
+		server.AnswerClient(request.Address, &GossipPacket{DownloadControl: answer})
+	} else if packet.StorageControl != nil {
+		answer := server.HandleStorageControl(state, packet.StorageControl)
+		server.AnswerClient(request.Address, &GossipPacket{StorageControl: answer})
+	} else if packet.ResolveControl != nil {
+		answer := server.HandleResolveControl(state, packet.ResolveControl)
+		server.AnswerClient(request.Address, &GossipPacket{ResolveControl: answer})
+	}
+}
+
+/* Send [answer] to the client at [address], if there is one */
+func (server *Gossiper) AnswerClient(address *net.UDPAddr, answer *GossipPacket) {
+	if server.ClientConn != nil {
+		SendPacket(server.ClientConn, Packet{Address: address, Content: answer})
 	}
 }
 
@@ -165,6 +203,14 @@ func (server *Gossiper) ServerHandler(state *State, request Packet) {
 		go server.HandleBroadcastWithLimit(state, sourceString, packet.TxPublish)
 	} else if packet.BlockPublish != nil {
 		go server.HandleBroadcastWithLimit(state, sourceString, packet.BlockPublish)
+	} else if packet.BlockRequest != nil {
+		go server.HandlePointToPointMessage(state, sourceString, packet.BlockRequest)
+	} else if packet.BlockReply != nil {
+		go server.HandlePointToPointMessage(state, sourceString, packet.BlockReply)
+	} else if packet.Have != nil {
+		go server.HandlePointToPointMessage(state, sourceString, packet.Have)
+	} else if packet.ChainStatus != nil {
+		go server.HandleChainStatus(state, sourceString, packet.ChainStatus)
 	}
 	fmt.Println("PEERS", state)
 }
@@ -213,69 +259,377 @@ func (server *Gossiper) HandleStatus(state *State, address string, remote_status
 	}
 }
 
-func (server *Gossiper) SendReplyWaitAnswer(state *State, peer string, hash []byte) DataReply {
-	dataRequest := NewDataRequest(server.Name, peer, hash)
-	ackr := NewAckRequest()
-	state.AddDataAck(peer, HashToUid(hash), *ackr)
-	for {
-		go server.HandlePointToPointMessage(state, server.Address.String(), dataRequest)
-		timeout := time.NewTimer(5 * time.Second)
-		select {
-		case <-timeout.C:
-			continue
-		case r := <-ackr.AckChannel:
-			ackr.Close()
-			return r.(DataReply)
-		}
+/* Return the content of [hash] if we already have it on disk */
+func readVerifiedHash(hash []byte) ([]byte, bool) {
+	if kind, data := ReadFileForHash(hash); kind != NoFileId {
+		reply := DataReply{HashValue: hash, Data: data}
+		return data, reply.IsValid()
 	}
+	return nil, false
 }
 
 // out_file is relative to the download folder
 // If peer is "" we will use our fileKnowledgeDb to select a good peer
-func (server *Gossiper) DownloadFile(state *State, peer string, metahash []byte, out_file string) {
-	peerMetaHash := state.FileKnowledgeDB.SelectPeerForMetaHash(peer, HashToUid(metahash))
-	metafilereply := server.SendReplyWaitAnswer(state, peerMetaHash, metahash)
-	metafile := metafilereply.Data
-	fmt.Println("DOWNLOADING metafile of", out_file, "from", peerMetaHash)
-	go WriteMetaFile(metafile)
-	metahashstring := GetMetaHash(metafile)
-	nparts := len(metafile) / 32
-	state.FileManager.AddFile(out_file, metahashstring, uint64(nparts))
-	var wg sync.WaitGroup
-	wg.Add(nparts)
-
-	for i := 0; i < len(metafile); i += 32 {
-		go func(i int) {
-			hash := metafile[i : i+32]
-			chunkhashstring := HashToUid(hash)
-			// here we do a conversion: chunks are counted starting 1
-			peerChunk := state.FileKnowledgeDB.SelectPeerForChunk(peer, metahashstring, i/32+1)
-			chunk := server.SendReplyWaitAnswer(state, peerChunk, hash)
-			WriteChunkFile(chunk.Data)
-			state.FileManager.AddChunk(metahashstring, chunkhashstring, uint64(i/32+1))
-			fmt.Println("DOWNLOADING", out_file, "chunk", i+1, "from", peerChunk)
-			wg.Done()
-		}(i)
-	}
-	wg.Wait()
-	ReconstructFile(out_file, metafile)
-	fmt.Println("RECONSTRUCTED file", out_file)
-}
-
-// path is relative to share folder
-func (server *Gossiper) UploadFile(state *State, path string) {
-	metafile, filesize := SplitFile(path)
+// Return true if the download succeeded
+func (server *Gossiper) DownloadFile(state *State, peer string, metahash []byte, out_file string) bool {
+	metahashstring := HashToUid(metahash)
+	download, err := state.Downloads.Start(out_file, metahashstring)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	journal, journalDone, err := OpenDownloadJournal(out_file, metahashstring, peer)
+	if err != nil {
+		fmt.Println(err)
+		download.AddError(err.Error())
+		download.Finish(DownloadFailed)
+		return false
+	}
+	/* a cancelled download is forgotten, a failed one can be resumed */
+	abort := func(reason string) {
+		if download.IsCancelled() {
+			fmt.Println("DOWNLOAD CANCELLED", out_file)
+			journal.Remove()
+		} else {
+			fmt.Println("DOWNLOAD FAILED", out_file, reason)
+			journal.Close()
+		}
+		download.Finish(DownloadFailed)
+	}
+
+	metafile, ok := server.FetchMetaFile(state, download, peer, metahash)
+	if !ok {
+		abort("no peer to get the metafile from")
+		return false
+	}
+	/* what we download can't be evicted before the end of the download */
+	pinned := []string{metahashstring}
+	ChunkStorage().Pin(metahashstring)
+	defer func() {
+		for _, uid := range pinned {
+			ChunkStorage().Unpin(uid)
+		}
+	}()
+
+	meta, err := ParseMetaFile(metafile)
+	if err != nil {
+		download.AddError(err.Error())
+		abort("invalid metafile")
+		return false
+	}
+	chunks, metafiles, ok := meta.Leaves(func(hashes [][]byte) ([][]byte, bool) {
+		return server.FetchMetaFiles(state, download, peer, hashes)
+	})
+	if !ok {
+		abort("can't get every sub metafile")
+		return false
+	}
+	for _, hash := range append(metafiles, chunks...) {
+		pinned = append(pinned, HashToUid(hash))
+		ChunkStorage().Pin(HashToUid(hash))
+	}
+	/* with erasure coding, some leaves are parity chunks */
+	stripes, err := ErasureStripes(meta.Header, len(chunks))
+	if err != nil {
+		download.AddError(err.Error())
+		abort("invalid metafile")
+		return false
+	}
+	dataChunks := ErasureDataChunks(stripes, chunks)
+	parity := make(map[uint64]bool)
+	for _, stripe := range stripes {
+		for _, pos := range stripe.Parity {
+			parity[uint64(pos+1)] = true
+		}
+	}
+
+	nparts := len(chunks)
+	if meta.Header.Kind == MetaKindDirectory {
+		state.FileManager.AddFile(DirectoryDisplayName(out_file), metahashstring, uint64(nparts))
+	} else {
+		state.FileManager.AddFile(out_file, metahashstring, uint64(nparts))
+	}
+	state.FileManager.AddMetaFiles(metahashstring, metafiles)
+	/* the journal tells which chunks are done, as long as the store
+	still has them. The others are tasks: fetch takes them from the store
+	if they are there anyway, for instance shared by another file */
+	tasks := []ChunkTask{}
+	lost := 0
+	for i, hash := range chunks {
+		// here we do a conversion: chunks are counted starting 1
+		chunkId := uint64(i + 1)
+		_, stored := readVerifiedHash(hash)
+		if journalDone[chunkId] && stored {
+			state.FileManager.AddChunk(metahashstring, HashToUid(hash), chunkId)
+		} else {
+			if journalDone[chunkId] {
+				lost += 1
+			}
+			tasks = append(tasks, ChunkTask{Id: chunkId, Hash: hash})
+		}
+	}
+	if len(journalDone) > 0 {
+		fmt.Println("RESUMING", out_file, len(journalDone)-lost, "chunks out of", nparts, "already downloaded,", lost, "lost")
+	}
+	missing := 0
+	for _, task := range tasks {
+		if !parity[task.Id] {
+			missing += 1
+		}
+	}
+	download.SetChunks(uint64(len(dataChunks)-missing), uint64(len(dataChunks)))
+
+	tasks = state.FileKnowledgeDB.OrderChunks(metahashstring, tasks)
+	fetch := func(task ChunkTask, attempts int) bool {
+		/* it may have been fetched since the start of the download, for
+		instance by a stream of the same file */
+		if _, ok := readVerifiedHash(task.Hash); ok {
+			journal.RecordChunk(task.Id)
+			state.FileManager.AddChunk(metahashstring, HashToUid(task.Hash), task.Id)
+			if !parity[task.Id] {
+				download.Found()
+			}
+			server.AnnounceChunk(state, metahashstring, task.Id)
+			return true
+		}
+		chunk, peerChunk, ok := server.FetchHashAttempts(state, download, task.Hash, attempts,
+			func(avoid map[string]bool) string {
+				return state.FileKnowledgeDB.SelectPeerForChunk(peer, metahashstring, int(task.Id), avoid)
+			})
+		if !ok {
+			fmt.Println("FAILED chunk", task.Id, "of", out_file)
+			return false
+		}
+		WriteChunkFile(chunk)
+		journal.RecordChunk(task.Id)
+		state.FileManager.AddChunk(metahashstring, HashToUid(task.Hash), task.Id)
+		download.Received(peerChunk, len(chunk), !parity[task.Id])
+		server.AnnounceChunk(state, metahashstring, task.Id)
+		fmt.Println("DOWNLOADING", out_file, "chunk", task.Id, "from", peerChunk)
+		return true
+	}
+	var success bool
+	if stripes == nil {
+		success = ScheduleChunks(tasks, func(task ChunkTask) bool {
+			return fetch(task, DOWNLOADRETRIES)
+		})
+	} else {
+		success = FetchErasureCoded(download, stripes, chunks, int(meta.Header.ErasureData), tasks, fetch,
+			func(task ChunkTask, chunk []byte) {
+				journal.RecordChunk(task.Id)
+				state.FileManager.AddChunk(metahashstring, HashToUid(task.Hash), task.Id)
+				if !parity[task.Id] {
+					download.Recovered()
+				}
+				server.AnnounceChunk(state, metahashstring, task.Id)
+				fmt.Println("RECOVERED", out_file, "chunk", task.Id)
+			})
+	}
+	if !success {
+		abort("no peer to get some chunks from")
+		return false
+	}
+	if meta.Header.Kind == MetaKindDirectory {
+		if !server.DownloadDirectory(state, download, peer, dataChunks, out_file) {
+			abort("can't download every file of the directory")
+			return false
+		}
+	} else {
+		ReconstructFile(out_file, dataChunks)
+		fmt.Println("RECONSTRUCTED file", out_file)
+	}
+	journal.Remove()
+	download.Finish(DownloadDone)
+	return true
+}
+
+/* Return the hashes of the metafile [metahash], of its sub metafiles
+and of its chunks, as far as the store knows them */
+func storedFileHashes(metahash string) []string {
+	uids := []string{metahash}
+	kind, metafile := ChunkStorage().Get(UidToHash(metahash))
+	if kind == NoFileId {
+		return uids
+	}
+	meta, err := ParseMetaFile(metafile)
+	if err != nil {
+		return uids
+	}
+	chunks, metafiles, ok := meta.Leaves(ReadStoredMetaFiles)
+	if !ok {
+		return uids
+	}
+	for _, hash := range append(metafiles, chunks...) {
+		uids = append(uids, HashToUid(hash))
+	}
+	return uids
+}
+
+/* Restart every download interrupted by a crash or a shutdown.
+What they already downloaded is pinned right away, before the quota is
+applied or a garbage collection can run, and until they finish */
+func (server *Gossiper) ResumeDownloads(state *State) {
+	for _, d := range ListUnfinishedDownloads() {
+		fmt.Println("RESUMING download of", d.Name)
+		pinned := storedFileHashes(d.MetaHash)
+		for _, uid := range pinned {
+			ChunkStorage().Pin(uid)
+		}
+		go func(d JournalRecord, pinned []string) {
+			server.DownloadFile(state, d.Peer, UidToHash(d.MetaHash), d.Name)
+			for _, uid := range pinned {
+				ChunkStorage().Unpin(uid)
+			}
+		}(d, pinned)
+	}
+}
+
+/* Download the file registered under [name] in the longest chain.
+If no peer is given and we don't know who has this file, we first
+search for it */
+func (server *Gossiper) DownloadFileByName(state *State, peer string, name string, out_file string) {
+	metahash, ok := state.BlockChain.ResolveName(name)
+	if !ok {
+		fmt.Println("UNKNOWN name", name)
+		return
+	}
+	server.DownloadResolvedName(state, peer, name, metahash, out_file)
+}
+
+/* Same as DownloadFileByName, [name] being already resolved to [metahash] */
+func (server *Gossiper) DownloadResolvedName(state *State, peer string, name string, metahash []byte, out_file string) {
+	if out_file == "" {
+		out_file = name
+	}
+	fmt.Println("RESOLVED", name, "to", HashToUid(metahash))
 
+	if peer == "" && !state.FileKnowledgeDB.KnowsMetaHash(HashToUid(metahash)) {
+		server.LaunchSearch(state, []string{name}, 0)
+		if !state.FileKnowledgeDB.KnowsMetaHash(HashToUid(metahash)) {
+			fmt.Println("NO PEER has", name)
+			return
+		}
+	}
+	server.DownloadFile(state, peer, metahash, out_file)
+}
+
+/* Store the metafile of a file we split and share it under [name].
+Return its metahash */
+func registerFile(state *State, name string, metafile []byte, chunks [][]byte) string {
 	metahashstring := GetMetaHash(metafile)
 	WriteMetaFile(metafile)
-	txpublish := NewTxPublish(path, UidToHash(metahashstring), filesize)
-	go server.HandleBroadcastWithLimit(state, server.Address.String(), &txpublish)
-	state.FileManager.AddFile(path, metahashstring, uint64(len(metafile)/32))
-	for i := 0; i < len(metafile); i += 32 {
-		hash := metafile[i : i+32]
+	state.FileManager.ShareFile(name, metahashstring, uint64(len(chunks)))
+	metafiles := StoredSubMetaFiles(metafile)
+	state.FileManager.AddMetaFiles(metahashstring, metafiles)
+	for i, hash := range chunks {
 		chunkhashstring := HashToUid(hash)
-		state.FileManager.AddChunk(metahashstring, chunkhashstring, uint64(i/32+1))
+		state.FileManager.AddChunk(metahashstring, chunkhashstring, uint64(i+1))
+	}
+	/* pinned by SplitReader */
+	for _, hash := range append(metafiles, chunks...) {
+		ChunkStorage().Unpin(HashToUid(hash))
+	}
+	return metahashstring
+}
+
+/* Split and index a file of the shared folder without publishing it.
+Return its metahash, the hashes of its chunks and its size */
+func (server *Gossiper) IndexFile(state *State, path string) (string, [][]byte, int64) {
+	metafile, chunks, filesize := SplitFile(path)
+	return registerFile(state, path, metafile, chunks), chunks, filesize
+}
+
+/* Index a file or a directory of the shared folder. Return its metahash
+and its size */
+func (server *Gossiper) IndexPath(state *State, path string) (string, int64, error) {
+	info, err := os.Stat(SHAREDFOLDER + path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if info.IsDir() {
+		metafile, chunks, size := server.IndexDirectory(state, path)
+		return registerFile(state, DirectoryDisplayName(path), metafile, chunks), size, nil
+	}
+	metahashstring, _, size := server.IndexFile(state, path)
+	return metahashstring, size, nil
+}
+
+// path is relative to share folder, and can be a directory
+func (server *Gossiper) UploadFile(state *State, path string) {
+	metahashstring, filesize, err := server.IndexPath(state, path)
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	if state.Shares != nil {
+		state.Shares.Share(path)
+	}
+
+	sequence := state.BlockChain.NextSequence(path, server.Key.Public().(ed25519.PublicKey))
+	txpublish := NewTxPublish(path, UidToHash(metahashstring), filesize, sequence)
+	txpublish.Sign(server.Key)
+	go server.HandleBroadcastWithLimit(state, server.Address.String(), &txpublish)
+}
+
+/* Index again the files we shared before the last shutdown. They are
+already published on the blockchain */
+func (server *Gossiper) RestoreShares(state *State) {
+	for _, path := range state.Shares.Names() {
+		if _, _, err := server.IndexPath(state, path); err != nil {
+			fmt.Println("CAN'T SHARE AGAIN", path, err)
+		} else {
+			fmt.Println("SHARING AGAIN", path)
+		}
+	}
+}
+
+/* Stop sharing a file or a directory. Its name stays on the blockchain,
+but its chunks can now be evicted or collected. Return the names removed */
+func (server *Gossiper) UnshareFile(state *State, path string) []string {
+	removed := state.FileManager.RemoveFile(path)
+	if state.Shares != nil {
+		state.Shares.Unshare(path)
+	}
+	fmt.Println("UNSHARED", path, len(removed), "files")
+	return removed
+}
+
+func (server *Gossiper) HandleStorageControl(state *State, control *StorageControl) *StorageControl {
+	answer := &StorageControl{
+		Action:  control.Action,
+		Target:  control.Target,
+		Removed: []string{},
+	}
+	if control.Action == StorageGC {
+		files, freed := ChunkStorage().CollectGarbage()
+		fmt.Println("GARBAGE COLLECTED", files, "files", freed, "bytes")
+		answer.Files = uint64(files)
+		answer.Freed = uint64(freed)
+	} else if control.Action == StorageUnshare {
+		answer.Removed = server.UnshareFile(state, control.Target)
+	}
+	used, quota := ChunkStorage().Usage()
+	answer.Used = uint64(used)
+	answer.Quota = uint64(quota)
+	return answer
+}
+
+func (server *Gossiper) HandleResolveControl(state *State, control *ResolveControl) *ResolveControl {
+	answer := &ResolveControl{
+		Name:     control.Name,
+		File:     control.File,
+		Peer:     control.Peer,
+		MetaHash: []byte{},
+	}
+	if metahash, ok := state.BlockChain.ResolveName(control.Name); ok {
+		answer.Ok = true
+		answer.MetaHash = metahash
+		go server.DownloadResolvedName(state, control.Peer, control.Name, metahash, control.File)
+	} else {
+		fmt.Println("UNKNOWN name", control.Name)
+	}
+	return answer
 }
 
 func (server *Gossiper) HandleSearchRequest(state *State, senderAddrString string, msg *SearchRequest) {
@@ -366,12 +720,59 @@ func (server *Gossiper) ListenBlockChainEvents(state *State) {
 	for {
 		select {
 		case block := <-state.BlockChain.ReleaseBlock:
-			next := NewBlockPublish(block)
+			next := NewBlockPublish(server.Name, block)
 			server.Broadcast(
 				"",
 				state,
 				next.ToPacket())
+
+		case missing := <-state.BlockChain.MissingBlock:
+			request := NewBlockRequest(server.Name, missing.From, missing.Hash, BLOCKSYNCBATCH)
+			go server.HandlePointToPointMessage(state, server.Address.String(), request)
+		}
+	}
+}
+
+func (server *Gossiper) SendChainStatus(state *State, address *net.UDPAddr) {
+	head, length, work := state.BlockChain.GetHead()
+	server.SendPacket(NewChainStatus(server.Name, head, length, work).ToPacket(), address)
+}
+
+/* Each time we discover a new neighbor, we tell him the state of our
+chain. Must be launched before adding peers */
+func (server *Gossiper) SyncChainLoop(state *State) {
+	newPeers := make(chan string, 64)
+	state.AddNewPeerCallback(newPeers)
+	go func() {
+		for peer := range newPeers {
+			if address, err := AddrOfString(peer); err == nil {
+				server.SendChainStatus(state, address)
+			}
+		}
+	}()
+}
+
+/* Compare the chain of a neighbor with ours. As for the fork choice,
+the best chain is the one which required the most work, not the longest.
+If his chain is better we download the blocks we miss, starting from his
+head and walking back by batches until our chains join. If ours is
+better, we tell him */
+func (server *Gossiper) HandleChainStatus(state *State, senderAddrString string, msg *ChainStatus) {
+	fmt.Println("CHAIN-STATUS from", msg.Origin, "length", msg.Length)
+	if _, ok := state.getRouteTo(msg.Origin); !ok && msg.Origin != server.Name {
+		state.UpdateRoutingTable(msg.Origin, senderAddrString)
+	}
+
+	_, _, work := state.BlockChain.GetHead()
+	theirs := new(big.Int).SetBytes(msg.Work)
+	if theirs.Cmp(work) > 0 {
+		if _, known := state.BlockChain.GetBlock(msg.Head); !known {
+			request := NewBlockRequest(server.Name, msg.Origin, msg.Head, BLOCKSYNCBATCH)
+			go server.HandlePointToPointMessage(state, server.Address.String(), request)
 		}
+	} else if theirs.Cmp(work) < 0 {
+		address, _ := AddrOfString(senderAddrString)
+		server.SendChainStatus(state, address)
 	}
 }
 
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+/* Every node owns an ed25519 key pair. The private key is stored in
+the temporary folder of the node so that the node keeps the same
+identity, and hence the ownership of its names, across restarts */
+
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	if content, err := ioutil.ReadFile(path); err == nil {
+		if len(content) != ed25519.PrivateKeySize {
+			return nil, errors.New("Corrupted key file " + path)
+		}
+		return ed25519.PrivateKey(content), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key, ioutil.WriteFile(path, key, 0600)
+}
+
+/* Hash of the content signed by the publisher of a transaction */
+func (t *TxPublish) SigningHash() (out [32]byte) {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian,
+		uint32(len(t.File.Name)))
+	h.Write([]byte(t.File.Name))
+	binary.Write(h, binary.LittleEndian, t.File.Size)
+	h.Write(t.File.MetafileHash)
+	h.Write(t.PublicKey)
+	binary.Write(h, binary.LittleEndian, t.Sequence)
+	copy(out[:], h.Sum(nil))
+	return
+}
+
+func (t *TxPublish) Sign(key ed25519.PrivateKey) {
+	t.PublicKey = key.Public().(ed25519.PublicKey)
+	hash := t.SigningHash()
+	t.Signature = ed25519.Sign(key, hash[:])
+}
+
+func (t *TxPublish) VerifySignature() bool {
+	if len(t.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	hash := t.SigningHash()
+	return ed25519.Verify(t.PublicKey, hash[:], t.Signature)
+}
+
+/* Only the first publisher of a name, its owner, can publish
+new metafiles for it */
+func (entry *BlockChainMapEntry) IsOwnedBy(publicKey []byte) bool {
+	return bytes.Equal(entry.owner, publicKey)
+}
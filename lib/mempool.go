@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"fmt"
+	"time"
+)
+
+/* Transactions waiting to be mined.
+- transactions included in the longest chain are removed, and put back
+if their block is rewinded
+- transactions expire after [MEMPOOLTTL]
+- at most [MEMPOOLSIZE] transactions are kept, the oldest ones are
+dropped first
+The mempool is only used by the goroutine working on the blockchain,
+hence there is no lock */
+
+var MEMPOOLTTL time.Duration = 10 * time.Minute
+var MEMPOOLSIZE int = 1024
+
+type mempoolEntry struct {
+	transaction TxPublish
+	added       time.Time
+}
+
+type Mempool struct {
+	entries map[[32]byte]*mempoolEntry
+	/* keys of the entries, from the oldest to the newest */
+	order    [][32]byte
+	ttl      time.Duration
+	capacity int
+}
+
+func NewMempool(ttl time.Duration, capacity int) *Mempool {
+	return &Mempool{
+		entries:  make(map[[32]byte]*mempoolEntry),
+		order:    [][32]byte{},
+		ttl:      ttl,
+		capacity: capacity,
+	}
+}
+
+func (m *Mempool) Contains(t *TxPublish) bool {
+	_, ok := m.entries[t.Hash()]
+	return ok
+}
+
+/* Return false if the transaction was already present */
+func (m *Mempool) Add(t TxPublish) bool {
+	key := t.Hash()
+	if _, ok := m.entries[key]; ok {
+		return false
+	}
+	for len(m.order) >= m.capacity {
+		fmt.Println("MEMPOOL full, dropping", m.entries[m.order[0]].transaction.File.Name)
+		delete(m.entries, m.order[0])
+		m.order = m.order[1:]
+	}
+	m.entries[key] = &mempoolEntry{transaction: t, added: time.Now()}
+	m.order = append(m.order, key)
+	return true
+}
+
+func (m *Mempool) Remove(t *TxPublish) {
+	key := t.Hash()
+	if _, ok := m.entries[key]; !ok {
+		return
+	}
+	delete(m.entries, key)
+	for i, k := range m.order {
+		if k == key {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+}
+
+/* Drop the transactions older than the ttl */
+func (m *Mempool) Expire() {
+	now := time.Now()
+	kept := [][32]byte{}
+	for _, key := range m.order {
+		if now.Sub(m.entries[key].added) > m.ttl {
+			fmt.Println("MEMPOOL expired", m.entries[key].transaction.File.Name)
+			delete(m.entries, key)
+		} else {
+			kept = append(kept, key)
+		}
+	}
+	m.order = kept
+}
+
+/* Transactions, from the oldest to the newest */
+func (m *Mempool) Transactions() []TxPublish {
+	out := []TxPublish{}
+	for _, key := range m.order {
+		out = append(out, m.entries[key].transaction)
+	}
+	return out
+}
+
+func (m *Mempool) Len() int {
+	return len(m.order)
+}
@@ -0,0 +1,221 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+/* The header of a block commits to its transactions through the root
+of a merkle tree built over the hashes of the transactions. When a level
+has an odd number of nodes, the last one goes up to the next level
+unchanged: pairing it with itself would give the same root to the lists
+[a, b, c] and [a, b, c, c]. Leaves and inner nodes are hashed with a
+different prefix, so that an inner node can't pass for a leaf.
+This allows a light node, knowing only the headers of the longest
+chain, to check that a transaction belongs to a block using a proof made
+of log(n) hashes */
+
+type BlockHeader struct {
+	PrevHash   [32]byte
+	Nonce      [32]byte
+	Timestamp  int64
+	Difficulty uint32
+	MerkleRoot [32]byte
+}
+
+func (h *BlockHeader) Hash() (out [32]byte) {
+	hash := sha256.New()
+	hash.Write(h.PrevHash[:])
+	hash.Write(h.Nonce[:])
+	binary.Write(hash, binary.LittleEndian, h.Timestamp)
+	binary.Write(hash, binary.LittleEndian, h.Difficulty)
+	hash.Write(h.MerkleRoot[:])
+	copy(out[:], hash.Sum(nil))
+	return
+}
+
+/* Path from a leaf to the root: the sibling of the node at each level,
+starting from the leaf, skipping the levels where the node has none.
+[Index] is the position of the leaf and [Count] the number of leaves */
+type MerkleProof struct {
+	Index    uint32
+	Count    uint32
+	Siblings [][32]byte
+}
+
+const (
+	merkleLeafPrefix  byte = 0
+	merkleInnerPrefix byte = 1
+)
+
+func merkleLeaf(hash [32]byte) [32]byte {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, hash[:]...))
+}
+
+func merkleParent(left [32]byte, right [32]byte) [32]byte {
+	data := append([]byte{merkleInnerPrefix}, left[:]...)
+	return sha256.Sum256(append(data, right[:]...))
+}
+
+func merkleLeaves(transactions []TxPublish) [][32]byte {
+	leaves := [][32]byte{}
+	for _, t := range transactions {
+		leaves = append(leaves, merkleLeaf(t.Hash()))
+	}
+	return leaves
+}
+
+/* Compute the next level of the tree */
+func merkleLevelUp(level [][32]byte) [][32]byte {
+	next := [][32]byte{}
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			next = append(next, merkleParent(level[i], level[i+1]))
+		} else {
+			next = append(next, level[i])
+		}
+	}
+	return next
+}
+
+/* The root of an empty list of transactions is the zero hash */
+func ComputeMerkleRoot(transactions []TxPublish) [32]byte {
+	level := merkleLeaves(transactions)
+	if len(level) == 0 {
+		return [32]byte{}
+	}
+	for len(level) > 1 {
+		level = merkleLevelUp(level)
+	}
+	return level[0]
+}
+
+func ComputeMerkleProof(transactions []TxPublish, index int) MerkleProof {
+	proof := MerkleProof{Index: uint32(index), Count: uint32(len(transactions)), Siblings: [][32]byte{}}
+	level := merkleLeaves(transactions)
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+		level = merkleLevelUp(level)
+		index /= 2
+	}
+	return proof
+}
+
+/* Check that the transaction whose hash is [leaf] is part of the tree
+[root]. The shape of the tree is given by the number of leaves */
+func VerifyMerkleProof(root [32]byte, leaf [32]byte, proof MerkleProof) bool {
+	if proof.Index >= proof.Count {
+		return false
+	}
+	current := merkleLeaf(leaf)
+	index, size := proof.Index, proof.Count
+	siblings := proof.Siblings
+	for size > 1 {
+		/* the last node of an odd level has no sibling */
+		if index != size-1 || index%2 != 0 {
+			if len(siblings) == 0 {
+				return false
+			}
+			if index%2 == 0 {
+				current = merkleParent(current, siblings[0])
+			} else {
+				current = merkleParent(siblings[0], current)
+			}
+			siblings = siblings[1:]
+		}
+		index /= 2
+		size = (size + 1) / 2
+	}
+	return len(siblings) == 0 && current == root
+}
+
+/* Everything needed to convince a light node that [Transaction] is
+included in the block [BlockHash] */
+type NameProof struct {
+	BlockHash   [32]byte
+	Transaction TxPublish
+	Proof       MerkleProof
+}
+
+/* Return the headers of the longest chain, from the head to the
+first block */
+func (bc *BlockChain) LongestChainHeaders() []BlockHeader {
+	headers := []BlockHeader{}
+	bc.Inspect(func(bc *BlockChain) {
+		current := bc.headChain
+		for !IsZeroHash(current[:]) {
+			node, ok := bc.blocks[current]
+			if !ok {
+				break
+			}
+			headers = append(headers, node.block.Header())
+			current = node.parent
+		}
+	})
+	return headers
+}
+
+/* Build a proof that the current registration of [name] is inside
+the longest chain. Return false if the name isn't registered */
+func (bc *BlockChain) ProveName(name string) (*NameProof, bool) {
+	var proof *NameProof
+	bc.Inspect(func(bc *BlockChain) {
+		entry, ok := bc.nameToHash[name]
+		if !ok {
+			return
+		}
+		current := entry.CurrentHash()
+		hash := bc.headChain
+		for proof == nil && !IsZeroHash(hash[:]) {
+			node, ok := bc.blocks[hash]
+			if !ok {
+				return
+			}
+			transactions := node.block.Transactions
+			for i := len(transactions) - 1; i >= 0; i-- {
+				t := transactions[i]
+				if t.File.Name == name && entry.IsOwnedBy(t.PublicKey) &&
+					t.MetafileHash32() == current && t.Sequence+1 == entry.NextSequence() {
+					proof = &NameProof{
+						BlockHash:   hash,
+						Transaction: t,
+						Proof:       ComputeMerkleProof(transactions, i),
+					}
+					break
+				}
+			}
+			hash = node.parent
+		}
+	})
+	return proof, proof != nil
+}
+
+/* Check, knowing only the [headers] of a chain (from the head to the
+first block) that the transaction of [proof] is part of this chain.
+The headers must be linked together and have a valid proof of work */
+func VerifyNameProof(headers []BlockHeader, proof *NameProof) bool {
+	if len(headers) == 0 || !proof.Transaction.VerifySignature() {
+		return false
+	}
+	last := headers[len(headers)-1]
+	if !IsZeroHash(last.PrevHash[:]) {
+		return false
+	}
+
+	var root *[32]byte
+	for i := range headers {
+		hash := headers[i].Hash()
+		if headers[i].Difficulty < MINDIFFICULTY || !HasLeadingZeroBits(hash, headers[i].Difficulty) {
+			return false
+		}
+		if i > 0 && headers[i-1].PrevHash != hash {
+			return false
+		}
+		if hash == proof.BlockHash {
+			root = &headers[i].MerkleRoot
+		}
+	}
+	return root != nil && VerifyMerkleProof(*root, proof.Transaction.Hash(), proof.Proof)
+}
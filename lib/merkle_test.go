@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+)
+
+func merkleTestTransactions(n int) []TxPublish {
+	out := []TxPublish{}
+	for i := 0; i < n; i++ {
+		out = append(out, NewTxPublish(fmt.Sprintf("file%d", i), []byte{byte(i)}, int64(i), 0))
+	}
+	return out
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		transactions := merkleTestTransactions(n)
+		root := ComputeMerkleRoot(transactions)
+		for i := range transactions {
+			proof := ComputeMerkleProof(transactions, i)
+			if !VerifyMerkleProof(root, transactions[i].Hash(), proof) {
+				t.Fatalf("valid proof of %d out of %d rejected", i, n)
+			}
+			other := transactions[(i+1)%n].Hash()
+			if n > 1 && VerifyMerkleProof(root, other, proof) {
+				t.Fatalf("proof of %d out of %d accepted for another transaction", i, n)
+			}
+			moved := proof
+			moved.Index = uint32((i + 1) % n)
+			if n > 1 && VerifyMerkleProof(root, transactions[i].Hash(), moved) {
+				t.Fatalf("proof of %d out of %d accepted at another position", i, n)
+			}
+			outside := proof
+			outside.Index = uint32(n)
+			if VerifyMerkleProof(root, transactions[i].Hash(), outside) {
+				t.Fatalf("proof of %d out of %d accepted outside of the tree", i, n)
+			}
+		}
+	}
+}
+
+func TestMerkleRootEmpty(t *testing.T) {
+	if ComputeMerkleRoot([]TxPublish{}) != [32]byte{} {
+		t.Fatal("the root of no transaction must be the zero hash")
+	}
+}
+
+/* [a, b, c] and [a, b, c, c] must not have the same root */
+func TestMerkleDuplicatedLast(t *testing.T) {
+	transactions := merkleTestTransactions(3)
+	duplicated := append(merkleTestTransactions(3), transactions[2])
+	if ComputeMerkleRoot(transactions) == ComputeMerkleRoot(duplicated) {
+		t.Fatal("duplicating the last transaction doesn't change the root")
+	}
+}
+
+/* An inner node can't be proven as a leaf of a smaller tree */
+func TestMerkleInnerNodeIsNotALeaf(t *testing.T) {
+	transactions := merkleTestTransactions(4)
+	root := ComputeMerkleRoot(transactions)
+	leaves := merkleLeaves(transactions)
+	inner := merkleParent(leaves[0], leaves[1])
+	right := merkleParent(leaves[2], leaves[3])
+	proof := MerkleProof{Index: 0, Count: 2, Siblings: [][32]byte{right}}
+	if VerifyMerkleProof(root, inner, proof) {
+		t.Fatal("an inner node was accepted as a leaf")
+	}
+}
+
+/* Register a name in a chain of a few blocks, and check its proof with
+the headers only */
+func TestNameProof(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := NewBlockChain()
+	bc.PinDifficulty(MINDIFFICULTY)
+	go bc.Work(false)
+
+	registered := NewTxPublish("name", []byte{1, 2, 3}, 42, 0)
+	registered.Sign(key)
+	blocks := [][]TxPublish{
+		merkleTestTransactions(3),
+		append(merkleTestTransactions(2), registered),
+		merkleTestTransactions(1),
+	}
+	prev := [32]byte{}
+	for _, transactions := range blocks {
+		block, _ := Mine(transactions, prev, 0, MINDIFFICULTY, 1, func() bool { return false })
+		bc.Inspect(func(bc *BlockChain) {
+			bc.AppendBlock(block)
+		})
+		prev = block.Hash()
+	}
+
+	proof, ok := bc.ProveName("name")
+	if !ok {
+		t.Fatal("no proof for a registered name")
+	}
+	headers := bc.LongestChainHeaders()
+	if len(headers) != len(blocks) {
+		t.Fatalf("%d headers for %d blocks", len(headers), len(blocks))
+	}
+	if !VerifyNameProof(headers, proof) {
+		t.Fatal("valid proof rejected")
+	}
+	if _, ok := bc.ProveName("unknown"); ok {
+		t.Fatal("proof for an unknown name")
+	}
+
+	tampered := *proof
+	tampered.Transaction.File.MetafileHash = []byte{4, 5, 6}
+	if VerifyNameProof(headers, &tampered) {
+		t.Fatal("proof with another metafile accepted")
+	}
+	tampered = *proof
+	tampered.Transaction.File.Size = 43
+	tampered.Transaction.Sign(key)
+	if VerifyNameProof(headers, &tampered) {
+		t.Fatal("proof with another size accepted")
+	}
+	tampered = *proof
+	tampered.Proof.Index = (proof.Proof.Index + 1) % proof.Proof.Count
+	if VerifyNameProof(headers, &tampered) {
+		t.Fatal("proof at another position accepted")
+	}
+	if VerifyNameProof(headers[:1], proof) {
+		t.Fatal("proof accepted with headers not reaching the first block")
+	}
+}
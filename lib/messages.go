@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"crypto/sha256"
 	"fmt"
 )
 
@@ -114,6 +115,14 @@ type GossipPacket struct {
 	SearchReply   *SearchReply
 	TxPublish     *TxPublish
 	BlockPublish  *BlockPublish
+	BlockRequest  *BlockRequest
+	BlockReply    *BlockReply
+	ChainStatus   *ChainStatus
+	Have          *HaveMessage
+	/* only exchanged between the client and its gossiper, see control.go */
+	DownloadControl *DownloadControl
+	StorageControl  *StorageControl
+	ResolveControl  *ResolveControl
 }
 
 func NewDataRequest(origin string, destination string, hash []byte) *DataRequest {
@@ -195,10 +204,18 @@ func (msg *DataRequest) OnFirstEmission(state *State) {
 }
 
 func (msg *DataRequest) OnReception(state *State, sendReply func(*GossipPacket)) {
+	/* someone fetching the metafile of a file is downloading it */
+	var introduction *HaveMessage
+	if state.FileManager.HasMetaHash(HashToUid(msg.HashValue)) {
+		introduction = state.Swarms.Introduce(msg.Destination, msg.Origin, msg.HashValue)
+	}
 	if _, data := ReadFileForHash(msg.HashValue); len(data) > 0 {
 		reply := NewDataReply(msg.Destination, msg.Origin, msg.HashValue, data)
 		sendReply(reply.ToPacket())
 	}
+	if introduction != nil {
+		sendReply(introduction.ToPacket())
+	}
 }
 
 func (msg *DataReply) ToPacket() *GossipPacket {
@@ -242,6 +259,17 @@ func (msg DataReply) String() string {
 	return msg.Origin + " -> " + msg.GetDestination() + "  " + HashToUid(msg.HashValue)
 }
 
+/* Both chunks and metafiles are named by the hash of their content */
+func (msg *DataReply) IsValid() bool {
+	hash := sha256.Sum256(msg.Data)
+	return HashToUid(hash[:]) == HashToUid(msg.HashValue)
+}
+
+/* Corrupted replies are still dispatched: the downloader waiting for
+it will reject it and try another peer */
 func (msg *DataReply) OnReception(state *State, sendReply func(*GossipPacket)) {
+	if !msg.IsValid() {
+		fmt.Println("CORRUPTED reply from", msg.Origin, "hash", HashToUid(msg.HashValue))
+	}
 	state.DispatchDataAck(msg.Origin, HashToUid(msg.HashValue), *msg)
 }
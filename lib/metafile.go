@@ -0,0 +1,246 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+/* Metafiles.
+
+A small file has a legacy metafile: the concatenation of the hashes of
+its chunks, as long as it fits inside one chunk.
+
+Bigger files use a tree. The root metafile is a header of 32 bytes
+followed by hashes. If the depth of the tree is 1 these are the hashes of
+the chunks, otherwise they are the hashes of sub metafiles, which are
+concatenations of hashes (without header) of depth - 1. Every metafile
+of the tree fits inside a chunk, so that it can be sent in one DataReply.
+Sub metafiles are stored and served like the root one.
+
+Header:
+ 0-3   magic "PMTF"
+ 4     version
+ 5     kind of content
+ 6     chunking mode
+ 7     depth of the tree
+ 8-15  size of the file, big endian
+ 16-23 number of chunks, big endian
+ 24    number of data chunks of a stripe, 0 without erasure coding
+ 25    number of parity chunks of a stripe
+ 26-31 reserved
+
+With erasure coding (see erasure.go) the chunks counted in the header
+include the parity chunks. */
+
+var METAFILEMAGIC = []byte("PMTF")
+
+const METAFILEVERSION uint8 = 1
+const METAFILEHEADERSIZE int = 32
+
+/* a deeper tree would describe more data than we can ever store */
+const METAFILEMAXDEPTH uint8 = 8
+
+const (
+	MetaKindFile uint8 = iota
+	/* the content is a DirectoryManifest */
+	MetaKindDirectory
+)
+
+const (
+	ChunkingFixed uint8 = iota
+	/* content defined chunking, see chunker.go */
+	ChunkingCDC
+)
+
+type MetaFileHeader struct {
+	Kind     uint8
+	Chunking uint8
+	Depth    uint8
+	Size     uint64
+	Chunks   uint64
+	/* erasure coding, 0 if disabled */
+	ErasureData   uint8
+	ErasureParity uint8
+}
+
+type MetaFile struct {
+	Header MetaFileHeader
+	/* true for a flat metafile without header */
+	Legacy bool
+	/* hashes of the chunks if the depth is 1, of the sub metafiles
+	otherwise */
+	Entries [][]byte
+}
+
+/* number of hashes a metafile without header can hold */
+func metaFileFanout() int {
+	return FILECHUNKSIZE / 32
+}
+
+func splitHashes(data []byte) ([][]byte, error) {
+	if len(data)%32 != 0 {
+		return nil, errors.New("metafile length is not a multiple of 32")
+	}
+	out := [][]byte{}
+	for i := 0; i < len(data); i += 32 {
+		out = append(out, data[i:i+32])
+	}
+	return out, nil
+}
+
+func (h *MetaFileHeader) Bytes() []byte {
+	out := make([]byte, METAFILEHEADERSIZE)
+	copy(out[0:4], METAFILEMAGIC)
+	out[4] = METAFILEVERSION
+	out[5] = h.Kind
+	out[6] = h.Chunking
+	out[7] = h.Depth
+	binary.BigEndian.PutUint64(out[8:16], h.Size)
+	binary.BigEndian.PutUint64(out[16:24], h.Chunks)
+	out[24] = h.ErasureData
+	out[25] = h.ErasureParity
+	return out
+}
+
+func ParseMetaFile(data []byte) (*MetaFile, error) {
+	if len(data) < METAFILEHEADERSIZE ||
+		!bytes.Equal(data[0:4], METAFILEMAGIC) ||
+		data[4] != METAFILEVERSION {
+		entries, err := splitHashes(data)
+		if err != nil {
+			return nil, err
+		}
+		return &MetaFile{
+			Header: MetaFileHeader{
+				Kind:     MetaKindFile,
+				Chunking: ChunkingFixed,
+				Depth:    1,
+				Chunks:   uint64(len(entries)),
+			},
+			Legacy:  true,
+			Entries: entries,
+		}, nil
+	}
+
+	header := MetaFileHeader{
+		Kind:     data[5],
+		Chunking: data[6],
+		Depth:    data[7],
+		Size:     binary.BigEndian.Uint64(data[8:16]),
+		Chunks:   binary.BigEndian.Uint64(data[16:24]),
+
+		ErasureData:   data[24],
+		ErasureParity: data[25],
+	}
+	if header.Depth == 0 || header.Depth > METAFILEMAXDEPTH {
+		return nil, errors.New("invalid depth for the metafile")
+	}
+	entries, err := splitHashes(data[METAFILEHEADERSIZE:])
+	if err != nil {
+		return nil, err
+	}
+	return &MetaFile{Header: header, Entries: entries}, nil
+}
+
+func (m *MetaFile) Bytes() []byte {
+	out := []byte{}
+	if !m.Legacy {
+		out = append(out, m.Header.Bytes()...)
+	}
+	for _, h := range m.Entries {
+		out = append(out, h...)
+	}
+	return out
+}
+
+/* Build the metafile of a file described by [header] whose chunks have
+the hashes [chunks]. Return the root metafile and the sub metafiles */
+func BuildMetaFile(header MetaFileHeader, chunks [][]byte) ([]byte, [][]byte) {
+	fanout := metaFileFanout()
+	if header.Kind == MetaKindFile && header.Chunking == ChunkingFixed &&
+		header.ErasureData == 0 && len(chunks) <= fanout {
+		legacy := MetaFile{Legacy: true, Entries: chunks}
+		return legacy.Bytes(), [][]byte{}
+	}
+
+	/* the root loses one slot for the header */
+	subs := [][]byte{}
+	level := chunks
+	header.Depth = 1
+	header.Chunks = uint64(len(chunks))
+	for len(level) > fanout-1 {
+		next := [][]byte{}
+		for i := 0; i < len(level); i += fanout {
+			end := i + fanout
+			if end > len(level) {
+				end = len(level)
+			}
+			node := bytes.Join(level[i:end], []byte{})
+			hash := sha256.Sum256(node)
+			subs = append(subs, node)
+			next = append(next, hash[:])
+		}
+		level = next
+		header.Depth += 1
+	}
+	root := MetaFile{Header: header, Entries: level}
+	return root.Bytes(), subs
+}
+
+/* Return the hashes of every chunk described by this metafile, in order,
+and the hashes of the sub metafiles.
+[readLevel] is called for each level of sub metafiles with their hashes,
+and must return their contents in the same order */
+func (m *MetaFile) Leaves(readLevel func(hashes [][]byte) ([][]byte, bool)) ([][]byte, [][]byte, bool) {
+	level := m.Entries
+	metafiles := [][]byte{}
+	for depth := m.Header.Depth; depth > 1; depth-- {
+		contents, ok := readLevel(level)
+		if !ok {
+			return nil, nil, false
+		}
+		metafiles = append(metafiles, level...)
+		next := [][]byte{}
+		for _, content := range contents {
+			entries, err := splitHashes(content)
+			if err != nil || len(entries) == 0 {
+				return nil, nil, false
+			}
+			next = append(next, entries...)
+		}
+		level = next
+	}
+	if !m.Legacy && uint64(len(level)) != m.Header.Chunks {
+		return nil, nil, false
+	}
+	return level, metafiles, true
+}
+
+/* To be given to Leaves: read sub metafiles from the store */
+func ReadStoredMetaFiles(hashes [][]byte) ([][]byte, bool) {
+	out := [][]byte{}
+	for _, h := range hashes {
+		kind, data := ChunkStorage().Get(h)
+		if kind == NoFileId {
+			return nil, false
+		}
+		out = append(out, data)
+	}
+	return out, true
+}
+
+/* Return the hashes of the sub metafiles of [metafile], read from the
+store */
+func StoredSubMetaFiles(metafile []byte) [][]byte {
+	meta, err := ParseMetaFile(metafile)
+	if err != nil {
+		return [][]byte{}
+	}
+	_, metafiles, ok := meta.Leaves(ReadStoredMetaFiles)
+	if !ok {
+		return [][]byte{}
+	}
+	return metafiles
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+func metaFileTestHashes(n int) [][]byte {
+	out := [][]byte{}
+	for i := 0; i < n; i++ {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(i))
+		hash := sha256.Sum256(buf[:])
+		out = append(out, hash[:])
+	}
+	return out
+}
+
+/* A readLevel for Leaves, reading the sub metafiles [subs] */
+func metaFileTestReader(subs [][]byte) func([][]byte) ([][]byte, bool) {
+	byHash := make(map[string][]byte)
+	for _, sub := range subs {
+		hash := sha256.Sum256(sub)
+		byHash[string(hash[:])] = sub
+	}
+	return func(hashes [][]byte) ([][]byte, bool) {
+		out := [][]byte{}
+		for _, h := range hashes {
+			sub, ok := byHash[string(h)]
+			if !ok {
+				return nil, false
+			}
+			out = append(out, sub)
+		}
+		return out, true
+	}
+}
+
+func TestMetaFileRoundTrip(t *testing.T) {
+	fanout := metaFileFanout()
+	cases := []struct {
+		chunks int
+		header MetaFileHeader
+		legacy bool
+		depth  uint8
+	}{
+		{0, MetaFileHeader{Kind: MetaKindFile}, true, 1},
+		{fanout, MetaFileHeader{Kind: MetaKindFile}, true, 1},
+		{fanout + 1, MetaFileHeader{Kind: MetaKindFile, Size: 123456}, false, 2},
+		{3, MetaFileHeader{Kind: MetaKindFile, Chunking: ChunkingCDC}, false, 1},
+		{3, MetaFileHeader{Kind: MetaKindDirectory}, false, 1},
+		{5, MetaFileHeader{Kind: MetaKindFile, ErasureData: 2, ErasureParity: 1}, false, 1},
+		{fanout * fanout, MetaFileHeader{Kind: MetaKindFile, Size: 1 << 40}, false, 3},
+	}
+	for _, c := range cases {
+		chunks := metaFileTestHashes(c.chunks)
+		root, subs := BuildMetaFile(c.header, chunks)
+		if len(root) > FILECHUNKSIZE {
+			t.Fatalf("root of %d chunks has %d bytes", c.chunks, len(root))
+		}
+		for _, sub := range subs {
+			if len(sub) > FILECHUNKSIZE {
+				t.Fatalf("sub metafile of %d bytes", len(sub))
+			}
+		}
+		meta, err := ParseMetaFile(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Legacy != c.legacy || meta.Header.Depth != c.depth {
+			t.Fatalf("%d chunks: legacy %v depth %d", c.chunks, meta.Legacy, meta.Header.Depth)
+		}
+		if !c.legacy {
+			expected := c.header
+			expected.Depth = c.depth
+			expected.Chunks = uint64(c.chunks)
+			if meta.Header != expected {
+				t.Fatalf("header %+v instead of %+v", meta.Header, expected)
+			}
+		}
+		if !bytes.Equal(meta.Bytes(), root) {
+			t.Fatal("the metafile changed when encoded again")
+		}
+		leaves, metafiles, ok := meta.Leaves(metaFileTestReader(subs))
+		if !ok {
+			t.Fatalf("can't read the leaves of %d chunks", c.chunks)
+		}
+		if len(leaves) != c.chunks || len(metafiles) != len(subs) {
+			t.Fatalf("%d leaves and %d metafiles instead of %d and %d",
+				len(leaves), len(metafiles), c.chunks, len(subs))
+		}
+		for i := range leaves {
+			if !bytes.Equal(leaves[i], chunks[i]) {
+				t.Fatalf("leaf %d out of %d differs", i, c.chunks)
+			}
+		}
+	}
+}
+
+func TestMetaFileMissingSubMetaFile(t *testing.T) {
+	root, subs := BuildMetaFile(MetaFileHeader{Kind: MetaKindFile}, metaFileTestHashes(3*metaFileFanout()))
+	meta, err := ParseMetaFile(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := meta.Leaves(metaFileTestReader(subs[1:])); ok {
+		t.Fatal("leaves read without every sub metafile")
+	}
+}
+
+/* The number of chunks of the header must match the leaves */
+func TestMetaFileWrongChunkCount(t *testing.T) {
+	header := MetaFileHeader{Kind: MetaKindFile, Depth: 1, Chunks: 4}
+	meta := MetaFile{Header: header, Entries: metaFileTestHashes(3)}
+	parsed, err := ParseMetaFile(meta.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := parsed.Leaves(metaFileTestReader(nil)); ok {
+		t.Fatal("leaves accepted with a wrong number of chunks")
+	}
+}
+
+func TestMetaFileInvalid(t *testing.T) {
+	if _, err := ParseMetaFile(make([]byte, 33)); err == nil {
+		t.Fatal("metafile of 33 bytes accepted")
+	}
+	for _, depth := range []uint8{0, METAFILEMAXDEPTH + 1} {
+		header := MetaFileHeader{Kind: MetaKindFile, Depth: depth}
+		if _, err := ParseMetaFile(header.Bytes()); err == nil {
+			t.Fatalf("metafile of depth %d accepted", depth)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/* Set the number of goroutines used to mine */
+func (bc *BlockChain) SetMiners(n int) {
+	if n > 0 {
+		bc.miners = n
+	}
+}
+
+/* Mine a block on top of [PrevHash] using [workers] goroutines.
+Every worker shares the same random suffix of the nonce and uses the 8
+first bytes as a counter: worker i tries the counters i, i + workers,
+i + 2 * workers... so no nonce is tried twice.
+Every worker stops as soon as one of them finds a block, or when
+[cancelled] returns true. In the later case nil is returned.
+The block can't be older than [minTimestamp], the timestamp of its
+parent, even if the clock of the peer who mined it is ahead of ours */
+func Mine(transactions []TxPublish, PrevHash [32]byte, minTimestamp int64, difficulty uint32, workers int, cancelled func() bool) (*Block, time.Duration) {
+	start := time.Now()
+	timestamp := start.Unix()
+	if timestamp < minTimestamp {
+		timestamp = minTimestamp
+	}
+
+	nonceSuffix := [32]byte{}
+	rand.Read(nonceSuffix[8:])
+	/* the merkle root is computed once for every nonce */
+	template := NewBlock(PrevHash, nonceSuffix, timestamp, difficulty, transactions)
+
+	var found int32 = 0
+	var hashes uint64 = 0
+	var result *Block
+	var wg sync.WaitGroup
+	wg.Add(workers)
+
+	for i := 0; i < workers; i++ {
+		go func(counter uint64) {
+			defer wg.Done()
+			block := *template
+			header := block.Header()
+			tried := uint64(0)
+			for atomic.LoadInt32(&found) == 0 && !cancelled() {
+				binary.LittleEndian.PutUint64(header.Nonce[:8], counter)
+				tried += 1
+				if HasLeadingZeroBits(header.Hash(), difficulty) && atomic.CompareAndSwapInt32(&found, 0, 1) {
+					block.Nonce = header.Nonce
+					result = &block
+				}
+				counter += uint64(workers)
+			}
+			atomic.AddUint64(&hashes, tried)
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	duration := time.Since(start)
+	fmt.Println("HASH-RATE", uint64(float64(hashes)/duration.Seconds()), "H/s with", workers, "miners")
+	if result != nil {
+		hash := result.Hash()
+		fmt.Println("FOUND-BLOCK", HashToUid(hash[:]))
+	}
+	return result, duration
+}
@@ -5,6 +5,20 @@ import (
 	"net"
 )
 
+/* Size of the buffer packets are read in, and the biggest payload an
+UDP packet can carry. A bigger packet can't be sent */
+var UDPBUFFERSIZE int = 65536
+var MAXPACKETSIZE int = 65507
+
+/* Size of [packet] once encoded */
+func PacketSize(packet *GossipPacket) int {
+	encoded, err := protobuf.Encode(packet)
+	if err != nil {
+		return 0
+	}
+	return len(encoded)
+}
+
 type Packet struct {
 	Address *net.UDPAddr
 	Content *GossipPacket
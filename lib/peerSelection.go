@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* A SelectionStrategy decides in which order the chunks of a file are
+downloaded and from which peer each one is requested */
+type SelectionStrategy interface {
+	/* Order the chunks to download. [holders] gives, for each chunk,
+	the number of peers known to have it */
+	OrderChunks(tasks []ChunkTask, holders map[uint64]int) []ChunkTask
+	/* Select one peer among [candidates] (never empty) to request a part
+	of [metahash] */
+	SelectPeer(metahash string, candidates []string) string
+	/* [peer] answered correctly to a request for [metahash] after [rtt] */
+	OnReply(metahash string, peer string, rtt time.Duration)
+	/* A request for [metahash] sent to [peer] is over, answered or not */
+	OnRequestDone(metahash string, peer string)
+}
+
+/* The historical strategy: chunks in order, random peers */
+type randomStrategy struct{}
+
+func NewRandomStrategy() SelectionStrategy {
+	return &randomStrategy{}
+}
+
+func (s *randomStrategy) OrderChunks(tasks []ChunkTask, holders map[uint64]int) []ChunkTask {
+	return tasks
+}
+
+func (s *randomStrategy) SelectPeer(metahash string, candidates []string) string {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+func (s *randomStrategy) OnReply(metahash string, peer string, rtt time.Duration) {}
+
+func (s *randomStrategy) OnRequestDone(metahash string, peer string) {}
+
+/* Strategy for downloads from a swarm:
+- the rarest chunks are downloaded first, so that they are not lost if
+their only holders leave
+- each peer has an estimation of its round trip time, computed as a moving
+average over its previous replies. Peers we never measured are assumed to
+be as fast as the fastest one, so that they get a chance.
+- the number of requests for chunks of a file in flight to each peer is
+counted, and the score of a peer (lower is better) is rtt * (1 + load), so
+that a fast peer doesn't end up serving the whole file */
+type swarmStrategy struct {
+	lock *sync.Mutex
+	rtt  map[string]time.Duration
+	/* metahash -> peer -> number of requests in flight, without the
+	zeros */
+	load map[string](map[string]int)
+}
+
+/* weight of the new measure in the moving average of the rtt */
+const RTTSMOOTHING float64 = 0.25
+
+func NewSwarmStrategy() SelectionStrategy {
+	return &swarmStrategy{
+		lock: &sync.Mutex{},
+		rtt:  make(map[string]time.Duration),
+		load: make(map[string](map[string]int)),
+	}
+}
+
+func (s *swarmStrategy) OrderChunks(tasks []ChunkTask, holders map[uint64]int) []ChunkTask {
+	out := make([]ChunkTask, len(tasks))
+	copy(out, tasks)
+	sort.SliceStable(out, func(i, j int) bool {
+		return holders[out[i].Id] < holders[out[j].Id]
+	})
+	return out
+}
+
+func (s *swarmStrategy) SelectPeer(metahash string, candidates []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	fastest := time.Duration(-1)
+	for _, p := range candidates {
+		if r, ok := s.rtt[p]; ok && (fastest < 0 || r < fastest) {
+			fastest = r
+		}
+	}
+	if fastest < 0 {
+		fastest = 0
+	}
+
+	if _, ok := s.load[metahash]; !ok {
+		s.load[metahash] = make(map[string]int)
+	}
+	load := s.load[metahash]
+
+	best := ""
+	var bestScore float64
+	/* start at a random position so that ties are broken randomly */
+	offset := rand.Intn(len(candidates))
+	for i := range candidates {
+		p := candidates[(i+offset)%len(candidates)]
+		r, ok := s.rtt[p]
+		if !ok {
+			r = fastest
+		}
+		/* add 1ms so that the load still matters when rtts are unknown */
+		score := float64(r+time.Millisecond) * float64(1+load[p])
+		if best == "" || score < bestScore {
+			best = p
+			bestScore = score
+		}
+	}
+	load[best] += 1
+	return best
+}
+
+func (s *swarmStrategy) OnReply(metahash string, peer string, rtt time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, ok := s.rtt[peer]; ok {
+		s.rtt[peer] = time.Duration((1-RTTSMOOTHING)*float64(old) + RTTSMOOTHING*float64(rtt))
+	} else {
+		s.rtt[peer] = rtt
+	}
+}
+
+func (s *swarmStrategy) OnRequestDone(metahash string, peer string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	/* the peer may have been chosen without us, when given by the user */
+	load, ok := s.load[metahash]
+	if !ok || load[peer] == 0 {
+		return
+	}
+	load[peer] -= 1
+	if load[peer] == 0 {
+		delete(load, peer)
+	}
+	if len(load) == 0 {
+		delete(s.load, metahash)
+	}
+}
+
+/* Return the strategy named [name], or nil if there is none */
+func SelectionStrategyByName(name string) SelectionStrategy {
+	switch name {
+	case "random":
+		return NewRandomStrategy()
+	case "swarm":
+		return NewSwarmStrategy()
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"encoding/json"
+)
+
+/* A RumorStore is the storage backend of a Database.
+The database keeps working in memory, but every inserted rumor
+is also handed to the store, so that it can be replayed when
+the node restarts */
+type RumorStore interface {
+	/* Return every rumor saved until now, in insertion order */
+	Load() ([]RumorMessage, error)
+	Append(msg *RumorMessage) error
+	Close() error
+}
+
+/* Store keeping nothing: used when we don't want persistence */
+type memoryRumorStore struct{}
+
+func NewMemoryRumorStore() RumorStore {
+	return &memoryRumorStore{}
+}
+
+func (s *memoryRumorStore) Load() ([]RumorMessage, error) {
+	return []RumorMessage{}, nil
+}
+
+func (s *memoryRumorStore) Append(msg *RumorMessage) error {
+	return nil
+}
+
+func (s *memoryRumorStore) Close() error {
+	return nil
+}
+
+/* Store writing every rumor inside an append only log */
+type logRumorStore struct {
+	log *appendLog
+}
+
+func NewLogRumorStore(path string) (RumorStore, error) {
+	log, err := newAppendLog(path)
+	if err != nil {
+		return nil, err
+	}
+	return &logRumorStore{log: log}, nil
+}
+
+func (s *logRumorStore) Load() ([]RumorMessage, error) {
+	out := []RumorMessage{}
+	err := s.log.replay(func(line []byte) error {
+		var msg RumorMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return err
+		}
+		out = append(out, msg)
+		return nil
+	})
+	return out, err
+}
+
+func (s *logRumorStore) Append(msg *RumorMessage) error {
+	return s.log.append(msg)
+}
+
+func (s *logRumorStore) Close() error {
+	return s.log.close()
+}
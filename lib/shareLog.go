@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+/* The files we share ourselves are recorded in an append only log, so
+that they are indexed again when the node restarts. Otherwise their
+chunks wouldn't be referenced anymore, and would be removed by the
+garbage collection */
+
+type ShareRecord struct {
+	Name    string
+	Removed bool `json:",omitempty"`
+}
+
+type ShareLog struct {
+	lock   *sync.Mutex
+	log    *appendLog
+	shared map[string]bool
+}
+
+func OpenShareLog(path string) (*ShareLog, error) {
+	log, err := newAppendLog(path)
+	if err != nil {
+		return nil, err
+	}
+	shares := &ShareLog{lock: &sync.Mutex{}, log: log, shared: make(map[string]bool)}
+	err = log.replay(func(line []byte) error {
+		var record ShareRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		if record.Removed {
+			delete(shares.shared, record.Name)
+		} else {
+			shares.shared[record.Name] = true
+		}
+		return nil
+	})
+	return shares, err
+}
+
+/* Names currently shared */
+func (l *ShareLog) Names() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	out := []string{}
+	for name := range l.shared {
+		out = append(out, name)
+	}
+	return out
+}
+
+func (l *ShareLog) Share(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.shared[name] {
+		l.shared[name] = true
+		l.log.append(ShareRecord{Name: name})
+	}
+}
+
+func (l *ShareLog) Unshare(name string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.shared[name] {
+		delete(l.shared, name)
+		l.log.append(ShareRecord{Name: name, Removed: true})
+	}
+}
@@ -49,6 +49,9 @@ type State struct {
 	FileKnowledgeDB          *FileKnowledgeDB
 	BroadcastWithLimitCacher *BroadcastWithLimitCacher
 	BlockChain               *BlockChain
+	Downloads                *DownloadManager
+	Swarms                   *SwarmDB
+	Shares                   *ShareLog
 }
 
 func (state *State) DispatchDataAck(peer string, hash string, ack DataReply) bool {
@@ -61,7 +64,7 @@ func (state *State) DispatchDataAck(peer string, hash string, ack DataReply) boo
 			if s.Empty() {
 				break
 			} else {
-				c := s.Pop().(AckRequest)
+				c := s.Pop().(*AckRequest)
 				if c.SendAck(ack) {
 					has_dispatched = true
 					break
@@ -77,7 +80,7 @@ func (state *State) DispatchDataAck(peer string, hash string, ack DataReply) boo
 	}
 }
 
-func (state *State) AddDataAck(peer string, hash string, c AckRequest) {
+func (state *State) AddDataAck(peer string, hash string, c *AckRequest) {
 	state.lockDataAck.Lock()
 	defer state.lockDataAck.Unlock()
 	key := DataAckKey{Peer: peer, Hash: hash}
@@ -116,10 +119,35 @@ func NewState() *State {
 		FileKnowledgeDB:          NewFileKnowledgeDB(),
 		BroadcastWithLimitCacher: NewBroadcastWithLimitCacher(),
 		BlockChain:               NewBlockChain(),
+		Downloads:                NewDownloadManager(),
+		Swarms:                   NewSwarmDB(),
 	}
 	return state
 }
 
+/* Make the state persistent: every data we want to survive a restart
+is stored inside the temporary folder of the node */
+func (state *State) OpenStorage() error {
+	store, err := NewLogRumorStore(TEMPFOLDER + "rumors.log")
+	if err != nil {
+		return err
+	}
+	if err := state.db.AttachStore(store); err != nil {
+		return err
+	}
+
+	blockStore, err := NewLogBlockStore(TEMPFOLDER + "blocks.log")
+	if err != nil {
+		return err
+	}
+	if err := state.BlockChain.AttachStore(blockStore); err != nil {
+		return err
+	}
+
+	state.Shares, err = OpenShareLog(TEMPFOLDER + "shares.log")
+	return err
+}
+
 func (state *State) getRouteTo(peer string) (string, bool) {
 	state.lock_routing.Lock()
 	defer state.lock_routing.Unlock()
@@ -0,0 +1,329 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+/* A ChunkStream reads a file chunk by chunk, in the chunk store or, for
+the chunks we don't have, from the network. It implements io.ReadSeeker
+so that the web server can serve a file while it is being downloaded,
+with support of range requests.
+
+With fixed size chunks the chunk containing an offset is known directly.
+With content defined chunks, the offset of a chunk is only known once
+every chunk before it was read, so seeking forward fetches them in order.
+
+What the stream reads is pinned until it is closed. If the file is also
+being downloaded, the chunks fetched by the stream are added to it, so
+that a preview moves the download forward.
+
+For an erasure coded file, only the data chunks are read; one which
+can't be fetched is rebuilt from the other chunks of its stripe */
+type ChunkStream struct {
+	server   *Gossiper
+	state    *State
+	peer     string
+	download *Download
+	chunks   [][]byte
+	size     int64
+	offset   int64
+	/* size of every chunk but the last one, 0 if it varies */
+	chunkSize int64
+	/* offsets of the first chunks, when the size varies */
+	starts []int64
+	/* last chunk read */
+	current      []byte
+	currentIndex int
+
+	/* ids of the chunks among the leaves of the metafile, which also
+	contain the parity chunks of an erasure coded file */
+	ids []uint64
+	/* for an erasure coded file: every leaf, the stripes, the stripe of
+	each chunk and the number of data chunks of a full stripe */
+	leaves   [][]byte
+	stripes  []ErasureStripe
+	stripeOf []int
+	k        int
+
+	metahash string
+	lock     *sync.Mutex
+	pinned   map[string]bool
+	closed   bool
+}
+
+/* Open the file [metahash], getting its metafile from [peer] or from a
+peer having it if needed */
+func (server *Gossiper) OpenStream(state *State, peer string, metahash []byte) (*ChunkStream, error) {
+	download := NewDownload("stream of "+HashToUid(metahash), HashToUid(metahash))
+	stream := &ChunkStream{
+		server:       server,
+		state:        state,
+		peer:         peer,
+		download:     download,
+		starts:       []int64{0},
+		currentIndex: -1,
+		metahash:     HashToUid(metahash),
+		lock:         &sync.Mutex{},
+		pinned:       make(map[string]bool),
+	}
+	metafile, ok := server.FetchMetaFile(state, download, peer, metahash)
+	if !ok {
+		return nil, errors.New("can't get the metafile")
+	}
+	stream.pin(metahash)
+	meta, err := ParseMetaFile(metafile)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if meta.Header.Kind != MetaKindFile {
+		stream.Close()
+		return nil, errors.New("not a file")
+	}
+	chunks, metafiles, ok := meta.Leaves(func(hashes [][]byte) ([][]byte, bool) {
+		return server.FetchMetaFiles(state, download, peer, hashes)
+	})
+	for _, hash := range metafiles {
+		stream.pin(hash)
+	}
+	if !ok {
+		stream.Close()
+		return nil, errors.New("can't get every sub metafile")
+	}
+	stripes, err := ErasureStripes(meta.Header, len(chunks))
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	ids := []uint64{}
+	for i := range chunks {
+		ids = append(ids, uint64(i+1))
+	}
+	if stripes != nil {
+		ids = []uint64{}
+		for si, stripe := range stripes {
+			for _, pos := range stripe.Data {
+				ids = append(ids, uint64(pos+1))
+				stream.stripeOf = append(stream.stripeOf, si)
+			}
+		}
+		stream.leaves = chunks
+		stream.stripes = stripes
+		stream.k = int(meta.Header.ErasureData)
+		chunks = ErasureDataChunks(stripes, chunks)
+	}
+
+	stream.chunks = chunks
+	stream.ids = ids
+	stream.size = int64(meta.Header.Size)
+	if meta.Header.Chunking == ChunkingFixed {
+		stream.chunkSize = int64(FILECHUNKSIZE)
+	}
+	/* a legacy metafile doesn't have the size of the file: it is
+	given by the size of the last chunk */
+	if meta.Legacy && len(chunks) > 0 {
+		last, err := stream.chunk(len(chunks) - 1)
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
+		stream.size = int64(len(chunks)-1)*stream.chunkSize + int64(len(last))
+	}
+	return stream, nil
+}
+
+/* Return the content of the [i]th chunk (counted starting 0) */
+func (s *ChunkStream) chunk(i int) ([]byte, error) {
+	if i == s.currentIndex {
+		return s.current, nil
+	}
+	var data []byte
+	ok := false
+	if s.stripes == nil {
+		data, ok = s.fetch(s.chunks[i], s.ids[i], DOWNLOADRETRIES)
+	} else {
+		/* like FetchErasureCoded: the chunk is tried again with every
+		attempt only if the stripe can't be recovered */
+		data, ok = s.fetch(s.chunks[i], s.ids[i], ERASUREDATAATTEMPTS)
+		if !ok {
+			data, ok = s.recover(i)
+		}
+		if !ok {
+			data, ok = s.fetch(s.chunks[i], s.ids[i], DOWNLOADRETRIES)
+		}
+	}
+	if !ok {
+		return nil, errors.New("can't get chunk " + HashToUid(s.chunks[i]))
+	}
+	if i == len(s.starts)-1 && i+1 < len(s.chunks) {
+		s.starts = append(s.starts, s.starts[i]+int64(len(data)))
+	}
+	s.current = data
+	s.currentIndex = i
+	return data, nil
+}
+
+/* Read the leaf [hash], of id [id], in the store or from the network
+in at most [attempts] attempts */
+func (s *ChunkStream) fetch(hash []byte, id uint64, attempts int) ([]byte, bool) {
+	data, ok := readVerifiedHash(hash)
+	if !ok {
+		data, _, ok = s.server.FetchHashAttempts(s.state, s.download, hash, attempts,
+			func(avoid map[string]bool) string {
+				return s.state.FileKnowledgeDB.SelectPeerForChunk(s.peer, s.download.Id, int(id), avoid)
+			})
+		if !ok {
+			return nil, false
+		}
+		s.store(hash, id, data)
+	}
+	s.pin(hash)
+	return data, true
+}
+
+func (s *ChunkStream) store(hash []byte, id uint64, data []byte) {
+	WriteChunkFile(data)
+	if s.state.FileManager.HasMetaHash(s.metahash) {
+		s.state.FileManager.AddChunk(s.metahash, HashToUid(hash), id)
+	}
+}
+
+/* Rebuild the [i]th chunk from as many other chunks of its stripe as it
+has data chunks, data ones first */
+func (s *ChunkStream) recover(i int) ([]byte, bool) {
+	stripe := s.stripes[s.stripeOf[i]]
+	missing := int(s.ids[i]) - 1
+	data := make([][]byte, len(stripe.Data))
+	parity := make([][]byte, len(stripe.Parity))
+	have := 0
+	target := -1
+	for j, pos := range stripe.Data {
+		if pos == missing {
+			target = j
+		} else if have < len(data) && !s.download.IsCancelled() {
+			if chunk, ok := s.fetch(s.leaves[pos], uint64(pos+1), DOWNLOADRETRIES); ok {
+				data[j] = chunk
+				have += 1
+			}
+		}
+	}
+	for j, pos := range stripe.Parity {
+		if have < len(data) && !s.download.IsCancelled() {
+			if chunk, ok := s.fetch(s.leaves[pos], uint64(pos+1), DOWNLOADRETRIES); ok {
+				parity[j] = chunk
+				have += 1
+			}
+		}
+	}
+	if have < len(data) {
+		return nil, false
+	}
+	decoded, err := DecodeStripe(data, parity, s.k)
+	if err != nil {
+		s.download.AddError(err.Error())
+		return nil, false
+	}
+	hash := sha256.Sum256(decoded[target])
+	if !bytes.Equal(hash[:], s.chunks[i]) {
+		s.download.AddError("recovered chunk " + HashToUid(s.chunks[i]) + " is invalid")
+		return nil, false
+	}
+	s.store(s.chunks[i], s.ids[i], decoded[target])
+	s.pin(s.chunks[i])
+	return decoded[target], true
+}
+
+/* Return the chunk containing [offset] and the offset where it starts */
+func (s *ChunkStream) locate(offset int64) (int, int64, error) {
+	if s.chunkSize > 0 {
+		i := int(offset / s.chunkSize)
+		return i, int64(i) * s.chunkSize, nil
+	}
+	for {
+		last := len(s.starts) - 1
+		if offset < s.starts[last] || last == len(s.chunks)-1 {
+			i := sort.Search(len(s.starts), func(j int) bool {
+				return s.starts[j] > offset
+			}) - 1
+			return i, s.starts[i], nil
+		}
+		/* reading the last known chunk gives the start of the next one */
+		if _, err := s.chunk(last); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+func (s *ChunkStream) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	i, start, err := s.locate(s.offset)
+	if err != nil {
+		return 0, err
+	}
+	if i >= len(s.chunks) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	data, err := s.chunk(i)
+	if err != nil {
+		return 0, err
+	}
+	if s.offset-start >= int64(len(data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, data[s.offset-start:])
+	s.offset += int64(n)
+	return n, nil
+}
+
+func (s *ChunkStream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+/* Keep [hash] in the store until the stream is closed */
+func (s *ChunkStream) pin(hash []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	uid := HashToUid(hash)
+	if s.closed || s.pinned[uid] {
+		return
+	}
+	s.pinned[uid] = true
+	ChunkStorage().Pin(uid)
+}
+
+/* Stop the requests in progress and unpin what was read */
+func (s *ChunkStream) Close() {
+	s.download.Cancel()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for uid := range s.pinned {
+		ChunkStorage().Unpin(uid)
+	}
+}
@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+/* Swarms: every peer downloading a file is also a source for it.
+Peers who asked us for the metafile of a file, or told us they have
+some of its chunks, are members of its swarm. Each time we get a new
+chunk of this file, we send a HaveMessage to every member, who can
+then request this chunk from us right away.
+Two peers downloading from the same seeder don't talk to each other
+first: when a peer asks us for the metafile, we also send it the members
+we know. It then announces its chunks to them, and they learn from its
+HaveMessages that it is a member too */
+
+type SwarmDB struct {
+	lock *sync.Mutex
+	/* metahash -> members */
+	members map[string](map[string]bool)
+}
+
+func NewSwarmDB() *SwarmDB {
+	return &SwarmDB{
+		lock:    &sync.Mutex{},
+		members: make(map[string](map[string]bool)),
+	}
+}
+
+func (s *SwarmDB) AddMember(metahash string, peer string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.members[metahash]; !ok {
+		s.members[metahash] = make(map[string]bool)
+	}
+	s.members[metahash][peer] = true
+}
+
+func (s *SwarmDB) Members(metahash string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	out := []string{}
+	for peer := range s.members[metahash] {
+		out = append(out, peer)
+	}
+	return out
+}
+
+/* Tell [Destination] that [Origin] has the chunks [Chunks] (counted
+starting 1) of the file [MetaHash], and that [Members] are in its swarm */
+type HaveMessage struct {
+	Origin      string
+	Destination string
+	HopLimit    uint32
+	MetaHash    []byte
+	Chunks      []uint64
+	Members     []string
+}
+
+func NewHaveMessage(origin string, destination string, metahash []byte, chunks []uint64) *HaveMessage {
+	return &HaveMessage{
+		Origin:      origin,
+		Destination: destination,
+		HopLimit:    10,
+		MetaHash:    metahash,
+		Chunks:      chunks,
+		Members:     []string{},
+	}
+}
+
+func (msg *HaveMessage) ToPacket() *GossipPacket {
+	return &GossipPacket{Have: msg}
+}
+
+func (msg *HaveMessage) GetOrigin() string {
+	return msg.Origin
+}
+
+func (msg *HaveMessage) GetDestination() string {
+	return msg.Destination
+}
+
+func (msg *HaveMessage) NextHop() (PointToPoint, bool) {
+	if msg.HopLimit <= 1 {
+		return msg, false
+	} else {
+		return &HaveMessage{
+			Origin:      msg.Origin,
+			Destination: msg.Destination,
+			HopLimit:    msg.HopLimit - 1,
+			MetaHash:    msg.MetaHash,
+			Chunks:      msg.Chunks,
+			Members:     msg.Members,
+		}, true
+	}
+}
+
+func (msg *HaveMessage) OnFirstEmission(state *State) {
+}
+
+func (msg *HaveMessage) OnReception(state *State, sendReply func(*GossipPacket)) {
+	metahash := HashToUid(msg.MetaHash)
+	if len(msg.Chunks) > 0 {
+		fmt.Println("HAVE", metahash, "chunks", msg.Chunks, "at", msg.Origin)
+	}
+	state.Swarms.AddMember(metahash, msg.Origin)
+	for _, chunkId := range msg.Chunks {
+		state.FileKnowledgeDB.Insert(metahash, int(chunkId), msg.Origin)
+	}
+	if len(msg.Members) > 0 {
+		fmt.Println("SWARM", metahash, "members", strings.Join(msg.Members, ","), "from", msg.Origin)
+	}
+	for _, member := range msg.Members {
+		if member != msg.Destination {
+			state.Swarms.AddMember(metahash, member)
+		}
+	}
+}
+
+/* Answer a peer [newcomer] joining the swarm of [metahash] with the
+members we know. Return nil if there is none */
+func (s *SwarmDB) Introduce(us string, newcomer string, metahash []byte) *HaveMessage {
+	members := []string{}
+	for _, member := range s.Members(HashToUid(metahash)) {
+		if member != newcomer && member != us {
+			members = append(members, member)
+		}
+	}
+	s.AddMember(HashToUid(metahash), newcomer)
+	if len(members) == 0 {
+		return nil
+	}
+	have := NewHaveMessage(us, newcomer, metahash, []uint64{})
+	have.Members = members
+	return have
+}
+
+/* Tell the swarm of [metahash] that we now have [chunkId] */
+func (server *Gossiper) AnnounceChunk(state *State, metahash string, chunkId uint64) {
+	for _, member := range state.Swarms.Members(metahash) {
+		if member == server.Name {
+			continue
+		}
+		have := NewHaveMessage(server.Name, member, UidToHash(metahash), []uint64{chunkId})
+		go server.HandlePointToPointMessage(state, server.Address.String(), have)
+	}
+}
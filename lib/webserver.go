@@ -20,6 +20,12 @@ type FileRequest struct {
 	Filename  string
 }
 
+type NameRequest struct {
+	Peer     string
+	Name     string
+	Filename string
+}
+
 type WebSearchResult struct {
 	FileName string
 	Keywords string
@@ -154,6 +160,17 @@ func NewWebServer(state *State, server *Gossiper, address string) *WebServer {
 			}
 		}).Methods("POST")
 
+	r.HandleFunc("/download/name",
+		func(_ http.ResponseWriter, r *http.Request) {
+			var message NameRequest
+			json.NewDecoder(r.Body).Decode(&message)
+			go server.DownloadFileByName(
+				state,
+				message.Peer,
+				message.Name,
+				message.Filename)
+		}).Methods("POST")
+
 	r.HandleFunc("/id",
 		func(w http.ResponseWriter, _ *http.Request) {
 			e := ServerId{Name: server.Name, Address: server.Address.String()}
@@ -197,6 +214,140 @@ func NewWebServer(state *State, server *Gossiper, address string) *WebServer {
 			websrv.private = []PrivateMessage{}
 		}).Methods("GET")
 
+	/* Block explorer */
+	r.HandleFunc("/blockchain/chain",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state.BlockChain.WebLongestChain())
+		}).Methods("GET")
+
+	r.HandleFunc("/blockchain/block/{hash}",
+		func(w http.ResponseWriter, r *http.Request) {
+			uid := mux.Vars(r)["hash"]
+			if !UidIsValidHash(uid) {
+				http.Error(w, "invalid hash", http.StatusBadRequest)
+				return
+			}
+			hash := [32]byte{}
+			copy(hash[:], UidToHash(uid))
+			block, ok := state.BlockChain.WebGetBlock(hash)
+			if !ok {
+				http.Error(w, "unknown block", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(block)
+		}).Methods("GET")
+
+	r.HandleFunc("/blockchain/forks",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state.BlockChain.WebLeaves())
+		}).Methods("GET")
+
+	r.HandleFunc("/blockchain/mempool",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state.BlockChain.WebMempool())
+		}).Methods("GET")
+
+	r.HandleFunc("/blockchain/name/{name}",
+		func(w http.ResponseWriter, r *http.Request) {
+			name, ok := state.BlockChain.WebResolveName(mux.Vars(r)["name"])
+			if !ok {
+				http.Error(w, "unknown name", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(name)
+		}).Methods("GET")
+
+	/* What a light node needs to check a name without the blocks: the
+	headers of the longest chain and the proof of the registration */
+	r.HandleFunc("/blockchain/headers",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state.BlockChain.LongestChainHeaders())
+		}).Methods("GET")
+
+	r.HandleFunc("/blockchain/proof/{name}",
+		func(w http.ResponseWriter, r *http.Request) {
+			proof, ok := state.BlockChain.ProveName(mux.Vars(r)["name"])
+			if !ok {
+				http.Error(w, "unknown name", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(proof)
+		}).Methods("GET")
+
+	r.HandleFunc("/downloads",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(state.Downloads.List())
+		}).Methods("GET")
+
+	r.HandleFunc("/downloads/{id}",
+		func(w http.ResponseWriter, r *http.Request) {
+			d, ok := state.Downloads.Get(mux.Vars(r)["id"])
+			if !ok {
+				http.Error(w, "unknown download", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(d.Progress())
+		}).Methods("GET")
+
+	r.HandleFunc("/downloads/{id}/cancel",
+		func(w http.ResponseWriter, r *http.Request) {
+			if !state.Downloads.Cancel(mux.Vars(r)["id"]) {
+				http.Error(w, "no running download", http.StatusNotFound)
+			}
+		}).Methods("POST")
+
+	r.HandleFunc("/storage",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(server.HandleStorageControl(state, &StorageControl{Action: StorageUsage}))
+		}).Methods("GET")
+
+	r.HandleFunc("/storage/gc",
+		func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(server.HandleStorageControl(state, &StorageControl{Action: StorageGC}))
+		}).Methods("POST")
+
+	r.HandleFunc("/unshare",
+		func(w http.ResponseWriter, r *http.Request) {
+			var name string
+			json.NewDecoder(r.Body).Decode(&name)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(server.HandleStorageControl(state, &StorageControl{Action: StorageUnshare, Target: name}))
+		}).Methods("POST")
+
+	/* Stream a file, downloading the chunks we miss when they are read.
+	?peer= gives the peer to download from, ?name= the name of the file,
+	used to guess its content type */
+	r.HandleFunc("/stream/{metahash}",
+		func(w http.ResponseWriter, r *http.Request) {
+			metahash := mux.Vars(r)["metahash"]
+			if !UidIsValidHash(metahash) {
+				http.Error(w, "invalid metahash", http.StatusBadRequest)
+				return
+			}
+			stream, err := server.OpenStream(state, r.URL.Query().Get("peer"), UidToHash(metahash))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			/* the context is done when the client leaves or when we answered */
+			go func() {
+				<-r.Context().Done()
+				stream.Close()
+			}()
+			http.ServeContent(w, r, r.URL.Query().Get("name"), time.Time{}, stream)
+		}).Methods("GET")
+
 	/* we also serve a bunch of static files */
 	r.PathPrefix("/").Handler(
 		http.StripPrefix("/", http.FileServer(http.Dir("./gui/dist"))))
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/poechsel/Peerster/lib"
 	"math/rand"
+	"runtime"
 	"strings"
 	"time"
 )
@@ -26,17 +27,49 @@ func main() {
 	gossip_name := flag.String("name", "123456789", "name of the gossiper")
 	peers_param := flag.String("peers", "", "comma separated list of peers of the form ip:port")
 	mine_continuously := flag.Bool("mine-flood", false, "mine continuously new blocks, including empty blocks")
+	difficulty := flag.Uint("difficulty", 0, "pin the proof of work difficulty to this number of leading zero bits, 0 for an adaptive difficulty")
+	miners := flag.Int("miners", runtime.NumCPU(), "number of goroutines used to mine")
+	downloadWindow := flag.Int("download-window", lib.DOWNLOADWINDOW, "maximum number of chunk requests in flight for one download")
+	selection := flag.String("selection", "swarm", "strategy to select chunks and peers when downloading: swarm (rarest first, fastest and least loaded peers) or random")
+	chunking := flag.String("chunking", "fixed", "how shared files are cut in chunks: fixed (8KiB chunks) or cdc (content defined, chunks from 2 to 16KiB)")
+	erasure := flag.String("erasure", "off", "erasure coding of the files we share: k,m adds m parity chunks to every k chunks, so that any k of them are enough to rebuild the others. off to disable")
+	quota := flag.Int64("quota", 0, "maximum size in MiB of the chunks stored in the temporary folder, 0 for no limit. Chunks of files we share ourselves are never evicted")
 	rtimer := flag.Int("rtimer", 0, "route rumors sending period in seconds, 0 to disable sending of route rumors")
 	var simple = flag.Bool("simple", false, "run gossiper in simple broadcast mode")
 	flag.Parse()
 	peers_list := strings.Split(*peers_param, ",")
 
 	lib.InitializeTempDir(*gossip_name)
+	if *downloadWindow > 0 {
+		lib.DOWNLOADWINDOW = *downloadWindow
+	}
+	if mode, ok := lib.ChunkingModeByName(*chunking); ok {
+		lib.CHUNKINGMODE = mode
+	} else {
+		fmt.Println("Unknown chunking mode", *chunking)
+	}
+	if k, m, ok := lib.ErasureParamsByName(*erasure); ok {
+		lib.ERASUREDATA = k
+		lib.ERASUREPARITY = m
+	} else {
+		fmt.Println("Invalid erasure coding parameters", *erasure)
+	}
 	/* create the current gossiper */
 	gossiper, err := lib.NewGossiper(*gossip_addr, *gossip_name, *simple, *rtimer)
 	fmt.Println("LISTENING ON: ", *gossip_addr)
 	lib.ExitIfError(err)
+	lib.ExitIfError(gossiper.LoadIdentity())
 	state := lib.NewState()
+	state.BlockChain.PinDifficulty(uint32(*difficulty))
+	state.BlockChain.SetMiners(*miners)
+	if strategy := lib.SelectionStrategyByName(*selection); strategy != nil {
+		state.FileKnowledgeDB.SetStrategy(strategy)
+	} else {
+		fmt.Println("Unknown selection strategy", *selection)
+	}
+	lib.ExitIfError(state.OpenStorage())
+	gossiper.RestoreMsgId(state)
+	gossiper.RestoreShares(state)
 	state.UpdateRoutingTable(gossiper.Name, gossiper.Address.String())
 
 	client_url := "127.0.0.1:" + *client_port
@@ -54,9 +87,13 @@ func main() {
 		corresponding messages */
 		client_server, err := lib.NewGossiper(client_url, "client", *simple, 0)
 		lib.ExitIfError(err)
+		gossiper.ClientConn = client_server.Conn
 		go client_server.ReceiveLoop(client_queue)
 	}
 
+	/* Exchange the state of our chain with every new neighbor */
+	gossiper.SyncChainLoop(state)
+
 	/* Add the peers given as parameters */
 	for _, peer_addr := range peers_list {
 		state.AddPeer(peer_addr)
@@ -76,6 +113,11 @@ func main() {
 	go gossiper.ListenBlockChainEvents(state)
 	go state.BlockChain.Work(*mine_continuously)
 
+	/* Restart the downloads interrupted by the last shutdown. The quota
+	is applied once their chunks are pinned */
+	gossiper.ResumeDownloads(state)
+	lib.ChunkStorage().SetQuota(*quota * 1024 * 1024)
+
 	/* loop on incoming messages */
 	for {
 		select {